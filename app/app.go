@@ -3,13 +3,16 @@ package main
 import (
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Cacsjep/goxis/pkg/acapapp"
-	"github.com/Cacsjep/goxis/pkg/dbus"
 	"github.com/gofiber/contrib/v3/websocket"
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/cors"
@@ -19,14 +22,41 @@ import (
 )
 
 type LegoApplication struct {
-	acapp           *acapapp.AcapApplication
-	webserver       *fiber.App
-	db              *gorm.DB
-	wsHub           *WSHub
-	vapixUser       string
-	vapixPass       string
-	vapixReady      bool
-	autoRenewTicker *time.Ticker
+	acapp       *acapapp.AcapApplication
+	webserver   *fiber.App
+	db          *gorm.DB
+	wsHub       *WSHub
+	vapixMu     sync.Mutex
+	vapixUser   string
+	vapixPass   string
+	vapixStatus VapixCredentialStatus
+	// vapixRetrieving is closed when the running D-Bus retrieval is done, nil if none runs.
+	vapixRetrieving     chan struct{}
+	autoRenewReschedule chan struct{}
+	scheduleMu          sync.Mutex
+	nextCheck           time.Time
+	lastCheck           *CheckOutcome
+	driftMu             sync.Mutex
+	lastDrift           *DriftStatus
+	revocationMu        sync.Mutex
+	lastRevocation      *RevocationStatus
+	ctMu                sync.Mutex
+	lastCT              *CTStatus
+	// legoMu guards legoBusy, the claim held while lego runs or its
+	// certificate files are written and installed.
+	legoMu   sync.Mutex
+	legoBusy bool
+	// backendMu guards backend, the detected install backend of the camera,
+	// and backendFor, the override it was detected for.
+	backendMu  sync.Mutex
+	backend    *certBackend
+	backendFor string
+	// pushMu serializes certificate pushes to remote devices.
+	pushMu sync.Mutex
+	// hookMu serializes deploy hook runs.
+	hookMu sync.Mutex
+	// shutdown is closed when the app stops, ending all background loops.
+	shutdown chan struct{}
 }
 
 func NewLegoApplication() *LegoApplication {
@@ -49,7 +79,7 @@ func (app *LegoApplication) Start() {
 	}
 	app.db = db
 
-	if err := db.AutoMigrate(&Config{}, &RunHistory{}); err != nil {
+	if err := db.AutoMigrate(&Config{}, &RunHistory{}, &RetryState{}, &ArchivedCert{}, &RemoteDevice{}, &DeployHook{}); err != nil {
 		app.acapp.Syslog.Critf("Failed to migrate database: %s", err)
 		return
 	}
@@ -58,6 +88,7 @@ func (app *LegoApplication) Start() {
 		app.acapp.Syslog.Critf("Failed to seed config: %s", err)
 		return
 	}
+	app.archiveExisting()
 
 	var httpBase, wsBase string
 	if UseBasePath {
@@ -73,17 +104,6 @@ func (app *LegoApplication) Start() {
 
 	app.wsHub = NewWSHub()
 
-	// Retrieve VAPIX credentials via D-Bus for cert installation
-	vapixUser, vapixPass, err := dbus.RetrieveVapixCredentials("root")
-	if err != nil {
-		app.acapp.Syslog.Infof("Could not retrieve VAPIX credentials: %s (cert install will be unavailable)", err)
-	} else {
-		app.vapixUser = vapixUser
-		app.vapixPass = vapixPass
-		app.vapixReady = true
-		app.acapp.Syslog.Info("VAPIX credentials retrieved successfully")
-	}
-
 	if !IsLegoReady() {
 		app.acapp.Syslog.Info("Lego binary not found, downloading...")
 		go func() {
@@ -99,12 +119,16 @@ func (app *LegoApplication) Start() {
 	app.webserver.Use(cors.New())
 	app.setupRoutes(httpBase, wsBase)
 
+	app.shutdown = make(chan struct{})
+	// VAPIX credentials for cert installation, retrieved via D-Bus
+	app.vapixStatus.State = VapixCredentialsPending
+	go app.vapixCredentialLoop()
 	app.startAutoRenew()
+	go app.driftLoop()
+	go app.ctLoop()
 
 	app.acapp.OnCloseCleaners = append(app.acapp.OnCloseCleaners, func() {
-		if app.autoRenewTicker != nil {
-			app.autoRenewTicker.Stop()
-		}
+		close(app.shutdown)
 		app.webserver.Shutdown()
 	})
 
@@ -116,73 +140,210 @@ func (app *LegoApplication) Start() {
 	}
 }
 
-func (app *LegoApplication) startAutoRenew() {
-	// Initial check after 30s delay (give time for lego download on first boot)
-	go func() {
-		time.Sleep(30 * time.Second)
-		app.checkAndAutoRenew()
-	}()
+// checkAndAutoRenew runs one scheduled check and reports what it decided and why.
+func (app *LegoApplication) checkAndAutoRenew() *CheckOutcome {
+	outcome := &CheckOutcome{CheckedAt: time.Now(), Outcome: CheckSkipped}
 
-	// Daily check
-	app.autoRenewTicker = time.NewTicker(24 * time.Hour)
-	go func() {
-		for range app.autoRenewTicker.C {
-			app.checkAndAutoRenew()
-		}
-	}()
-}
-
-func (app *LegoApplication) checkAndAutoRenew() {
 	config, err := GetConfig(app.db)
-	if err != nil || !config.AutoMode {
-		return
-	}
-	if !IsLegoReady() {
-		return
+	if err != nil {
+		outcome.Reason = "no config found"
+		return outcome
 	}
 
+	// Revocation is monitored even when auto mode is off
 	domain := primaryDomain(config)
+	var revocation *RevocationStatus
+	if domain != "" && fileExists(legoCertPath(domain, ".crt")) {
+		revocation = app.refreshRevocation(domain)
+	}
+
+	if !config.AutoMode {
+		outcome.Reason = "auto mode is disabled"
+		return outcome
+	}
+	if !IsLegoReady() {
+		outcome.Reason = "lego binary not downloaded"
+		return outcome
+	}
 	if domain == "" {
-		return
+		outcome.Reason = "no domain configured"
+		return outcome
 	}
 
-	certFile := legoCertsPath + "/certificates/" + domain + ".crt"
-	days, err := getCertDaysRemaining(certFile)
-	if err != nil {
-		return // no cert yet or can't parse
+	result := decideEnsure(app.db, config)
+	if revocation != nil && revocation.Status == RevocationRevoked && result.Action != EnsureObtain && !result.Imported {
+		result = &EnsureResult{Action: EnsureReissue, Reason: "certificate has been revoked"}
+	}
+	outcome.Action = result.Action
+	outcome.Reason = result.Reason
+	if result.Action == EnsureObtain && !isConfigComplete(config) {
+		app.acapp.Syslog.Infof("No certificate for %s yet, but config is incomplete", domain)
+		outcome.Reason = "no certificate yet, but config is incomplete"
+		return outcome
 	}
 
-	app.acapp.Syslog.Infof("Certificate expires in %d days (threshold: %d)", days, config.AutoDays)
+	// A scheduled check before the retry is due must not run lego either, the
+	// CA may have asked to wait longer than the check interval
+	if result.Action != EnsureNone {
+		if retry, rerr := GetRetryState(app.db); rerr == nil && retry.backingOff(outcome.CheckedAt) {
+			outcome.Reason = fmt.Sprintf("backing off until %s after %d failure(s)",
+				retry.NextRetryAt.Format(time.RFC3339), retry.Failures)
+			return outcome
+		}
+	}
 
-	if days > config.AutoDays {
-		return
+	if !app.claimLego() {
+		outcome.Reason = errLegoBusy.Error()
+		return outcome
+	}
+	result, err = app.applyEnsure(config, result, TriggerAuto)
+	app.releaseLego()
+	if result.Run != nil && !result.Run.Success {
+		app.acapp.Syslog.Errorf("Auto-%s failed: %s", result.Action, err)
+		outcome.Outcome = CheckFailed
+		outcome.Reason = err.Error()
+		if retry, rerr := RecordRenewFailure(app.db, result.Run.Output, err); rerr != nil {
+			app.acapp.Syslog.Errorf("Failed to save retry state: %s", rerr)
+		} else {
+			app.acapp.Syslog.Infof("Auto-%s failed %d time(s) in a row, retrying at %s",
+				result.Action, retry.Failures, retry.NextRetryAt.Format(time.RFC3339))
+		}
+		return outcome
+	}
+	if err := ResetRetryState(app.db); err != nil {
+		app.acapp.Syslog.Errorf("Failed to reset retry state: %s", err)
+	}
+
+	switch {
+	case err != nil:
+		outcome.Outcome = CheckFailed
+		outcome.Reason = err.Error()
+	case result.Action == EnsureNone && !result.Installed:
+		outcome.Outcome = CheckNoAction
+	default:
+		outcome.Outcome = CheckSuccess
+	}
+	return outcome
+}
+
+// historyCommand returns the command name stored in the run history.
+// Automatic runs are prefixed with "auto-", e.g. "auto-renew".
+func historyCommand(command, trigger string) string {
+	if trigger == TriggerAuto {
+		return "auto-" + command
 	}
+	return command
+}
 
-	// Auto-renew
-	app.acapp.Syslog.Infof("Auto-renewing certificate (expires in %d days)", days)
-	output, err := RunLego(config, app.wsHub, "renew", app.acapp.Syslog.Infof)
-	SaveRunHistory(app.db, "auto-renew", err == nil, output)
+// requestTrigger returns the run trigger for an API request. The web UI
+// passes ?trigger=manual, everything else is recorded as an API call.
+func requestTrigger(c fiber.Ctx) string {
+	if c.Query("trigger") == TriggerManual {
+		return TriggerManual
+	}
+	return TriggerAPI
+}
 
+// recordCertState stores serial and expiry of the certificate currently on disk in run.
+func recordCertState(run *RunHistory, domain string) {
+	cert, err := loadCertificate(legoCertPath(domain, ".crt"))
 	if err != nil {
-		app.acapp.Syslog.Errorf("Auto-renew failed: %s", err)
 		return
 	}
+	notAfter := cert.NotAfter
+	run.CertSerial = cert.SerialNumber.String()
+	run.CertNotAfter = &notAfter
+}
 
-	// Auto-install
-	if !app.vapixReady {
-		app.acapp.Syslog.Infof("Skipping auto-install: VAPIX credentials not available")
-		return
+// runLegoRecorded runs a lego command and stores the outcome in the run history.
+// The caller holds the lego claim.
+func (app *LegoApplication) runLegoRecorded(config *Config, command, trigger string) (*RunHistory, error) {
+	var previousSerial string
+	if cert, cerr := loadCertificate(legoCertPath(primaryDomain(config), ".crt")); cerr == nil {
+		previousSerial = cert.SerialNumber.String()
+	}
+	hooks, hookPath := app.prepareLegoHooks()
+	result, err := RunLego(config, app.wsHub, command, hookPath, app.acapp.Syslog.Infof)
+	run := &RunHistory{
+		Command:    historyCommand(command, trigger),
+		Trigger:    trigger,
+		Success:    err == nil,
+		ExitCode:   result.ExitCode,
+		Output:     result.Output,
+		StartedAt:  result.StartedAt,
+		FinishedAt: result.FinishedAt,
+		CAServer:   config.CAServer,
+	}
+	if version, verr := GetLegoVersion(); verr == nil {
+		run.LegoVersion = version
+	}
+	recordCertState(run, primaryDomain(config))
+	if serr := SaveRunHistory(app.db, run); serr != nil {
+		app.acapp.Syslog.Errorf("Failed to save run history: %s", serr)
 	}
-	app.acapp.Syslog.Infof("Auto-installing certificate for %s", domain)
-	if err := InstallCertToCamera(app.vapixUser, app.vapixPass, domain); err != nil {
-		app.acapp.Syslog.Errorf("Auto-install failed: %s", err)
-		SaveRunHistory(app.db, "auto-install", false, err.Error())
-		app.wsHub.Broadcast(MsgLegoError, map[string]string{"error": "Auto-install failed: " + err.Error()})
+	if len(hooks) > 0 {
+		app.recordLegoHooks(hooks, primaryDomain(config), run)
+	}
+	// Only a new certificate is archived, pushed and handed to deploy hooks
+	if run.Success && run.CertSerial != previousSerial {
+		app.afterIssued(primaryDomain(config), run)
+	}
+	return run, err
+}
+
+// installRecorded installs the certificate for domain to the camera and stores the
+// attempt in the run history. If legoRun is set, it is linked to the install record.
+func (app *LegoApplication) installRecorded(domain, trigger string, legoRun *RunHistory) error {
+	return app.installRecordedAs("install", domain, trigger, legoRun)
+}
+
+// installRecordedAs is installRecorded with the command stored in the run history.
+func (app *LegoApplication) installRecordedAs(command, domain, trigger string, legoRun *RunHistory) error {
+	run := &RunHistory{
+		Command:   historyCommand(command, trigger),
+		Trigger:   trigger,
+		StartedAt: time.Now(),
+	}
+	policy, targets := &HTTPSPolicy{}, []string{TargetWebServer}
+	config, cerr := GetConfig(app.db)
+	if cerr == nil {
+		policy = HTTPSPolicyFromConfig(config)
+		if t, terr := installTargetsFor(config, domain); terr == nil {
+			targets = t
+		}
+	}
+	dev := app.localDevice()
+	var steps []string
+	hostname, err := cameraHostname(dev, config)
+	if err == nil {
+		err = InstallCertToCamera(dev, domain, hostname, policy, targets, func(step InstallStep) {
+			steps = append(steps, step.String())
+			app.wsHub.Broadcast(MsgInstallStep, step)
+		})
+	}
+	run.FinishedAt = time.Now()
+	run.Success = err == nil
+	if err != nil {
+		steps = append(steps, err.Error())
 	} else {
-		app.acapp.Syslog.Infof("Auto-install successful for %s", domain)
-		SaveRunHistory(app.db, "auto-install", true, "Certificate installed successfully")
-		app.wsHub.Broadcast(MsgLegoComplete, map[string]string{"message": "Certificate auto-installed to camera"})
+		steps = append(steps, "Certificate installed successfully")
+	}
+	run.Output = strings.Join(steps, "\n")
+	recordCertState(run, domain)
+
+	if serr := SaveRunHistory(app.db, run); serr != nil {
+		app.acapp.Syslog.Errorf("Failed to save run history: %s", serr)
+		return err
+	}
+	if legoRun != nil && legoRun.ID != 0 {
+		if lerr := LinkInstallRun(app.db, legoRun.ID, run.ID); lerr != nil {
+			app.acapp.Syslog.Errorf("Failed to link install run: %s", lerr)
+		}
+	}
+	if err == nil {
+		go app.runDeployHooks(HookOnInstall, domain, run)
 	}
+	return err
 }
 
 func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
@@ -205,6 +366,7 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 			"lego_ready":   IsLegoReady(),
 			"lego_running": IsLegoRunning(),
 			"arch":         LegoArch,
+			"vapix":        app.vapixCredentialStatus(),
 		})
 	})
 
@@ -247,6 +409,18 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 		if err := c.Bind().JSON(&config); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
+		if err := validateSchedule(&config); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := validateHTTPSPolicy(&config); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := validateInstallTargets(&config); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := validateInstallBackend(config.InstallBackend); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
 		existing, _ := GetConfig(app.db)
 		if existing != nil {
 			config.ID = existing.ID
@@ -254,6 +428,8 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 		if err := SaveConfig(app.db, &config); err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
+		app.rescheduleAutoRenew()
+		app.resetCertBackend()
 		return c.JSON(config)
 	})
 
@@ -271,10 +447,13 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 		if err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
 		}
+		if !app.claimLego() {
+			return c.Status(409).JSON(fiber.Map{"error": "Lego is already running"})
+		}
+		trigger := requestTrigger(c)
 		go func() {
-			output, err := RunLego(config, app.wsHub, "obtain", app.acapp.Syslog.Infof)
-			SaveRunHistory(app.db, "obtain", err == nil, output)
-			if err != nil {
+			defer app.releaseLego()
+			if _, err := app.runLegoRecorded(config, "obtain", trigger); err != nil {
 				app.acapp.Syslog.Errorf("Lego obtain failed: %s", err)
 			}
 		}()
@@ -286,16 +465,44 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 		if err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
 		}
+		if currentCertImported(app.db, primaryDomain(config)) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "The certificate was imported, lego can't renew it. Import a renewed one or obtain a new one.",
+			})
+		}
+		if !app.claimLego() {
+			return c.Status(409).JSON(fiber.Map{"error": "Lego is already running"})
+		}
+		trigger := requestTrigger(c)
 		go func() {
-			output, err := RunLego(config, app.wsHub, "renew", app.acapp.Syslog.Infof)
-			SaveRunHistory(app.db, "renew", err == nil, output)
-			if err != nil {
+			defer app.releaseLego()
+			if _, err := app.runLegoRecorded(config, "renew", trigger); err != nil {
 				app.acapp.Syslog.Errorf("Lego renew failed: %s", err)
 			}
 		}()
 		return c.JSON(fiber.Map{"message": "Certificate renewal started"})
 	})
 
+	api.Get("/schedule", func(c fiber.Ctx) error {
+		return c.JSON(app.scheduleState())
+	})
+
+	api.Post("/ensure", func(c fiber.Ctx) error {
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		result, err := app.startEnsure(config, requestTrigger(c))
+		if err != nil {
+			return c.Status(409).JSON(fiber.Map{"error": "Lego is already running"})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Ensure started",
+			"action":  result.Action,
+			"reason":  result.Reason,
+		})
+	})
+
 	api.Get("/runs/last", func(c fiber.Ctx) error {
 		run, err := GetLastRun(app.db)
 		if err != nil {
@@ -310,8 +517,8 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
 		}
 		domain := primaryDomain(config)
-		certFile := legoCertsPath + "/certificates/" + domain + ".crt"
-		keyFile := legoCertsPath + "/certificates/" + domain + ".key"
+		certFile := legoCertPath(domain, ".crt")
+		keyFile := legoCertPath(domain, ".key")
 
 		certExists := fileExists(certFile)
 		keyExists := fileExists(keyFile)
@@ -330,13 +537,75 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 				result["not_after"] = info["not_after"]
 				result["san"] = info["san"]
 				result["serial"] = info["serial"]
+				if rev := app.getLastRevocation(); rev != nil && rev.Serial == info["serial"] {
+					result["revocation"] = rev
+				}
 			}
 		}
 
 		return c.JSON(result)
 	})
 
-	api.Get("/cert/download/:type", func(c fiber.Ctx) error {
+	api.Get("/cert/inspect", func(c fiber.Ctx) error {
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		inspection, err := inspectChain(primaryDomain(config))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(inspection)
+	})
+
+	api.Post("/cert/revocation/check", func(c fiber.Ctx) error {
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		return c.JSON(app.refreshRevocation(primaryDomain(config)))
+	})
+
+	api.Get("/cert/drift", func(c fiber.Ctx) error {
+		status := app.getLastDrift()
+		if status == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "No drift check yet"})
+		}
+		return c.JSON(status)
+	})
+
+	api.Post("/cert/drift/check", func(c fiber.Ctx) error {
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		return c.JSON(app.checkDrift(config))
+	})
+
+	api.Get("/ct", func(c fiber.Ctx) error {
+		status := app.getLastCT()
+		if status == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "No CT check yet"})
+		}
+		return c.JSON(status)
+	})
+
+	api.Post("/ct/check", func(c fiber.Ctx) error {
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		return c.JSON(app.checkCT(config))
+	})
+
+	// Export passwords are never read from the URL, where they would end up
+	// in access logs and browser history.
+	download := func(c fiber.Ctx, password string) error {
+		if c.Query("password") != "" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Pass the export password in the " + exportPasswordHeader + " header or a POST body, not the URL",
+			})
+		}
 		config, err := GetConfig(app.db)
 		if err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
@@ -347,16 +616,30 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 		var filePath, fileName string
 		switch fileType {
 		case "crt":
-			filePath = legoCertsPath + "/certificates/" + domain + ".crt"
+			filePath = legoCertPath(domain, ".crt")
 			fileName = domain + ".crt"
 		case "key":
-			filePath = legoCertsPath + "/certificates/" + domain + ".key"
+			filePath = legoCertPath(domain, ".key")
 			fileName = domain + ".key"
 		case "issuer":
-			filePath = legoCertsPath + "/certificates/" + domain + ".issuer.crt"
+			filePath = legoCertPath(domain, ".issuer.crt")
 			fileName = domain + ".issuer.crt"
 		default:
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid type, use: crt, key, issuer"})
+			if !slices.Contains(exportTypes, fileType) {
+				return c.Status(400).JSON(fiber.Map{
+					"error": "Invalid type, use: crt, key, issuer, " + strings.Join(exportTypes, ", "),
+				})
+			}
+			if !fileExists(legoCertPath(domain, ".crt")) {
+				return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+			}
+			export, err := buildExport(domain, fileType, password, c.Query("legacy") == "1")
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+			}
+			c.Set("Content-Type", export.ContentType)
+			c.Set("Content-Disposition", "attachment; filename=\""+export.Name+"\"")
+			return c.Send(export.Data)
 		}
 
 		if !fileExists(filePath) {
@@ -365,10 +648,378 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 
 		c.Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
 		return c.SendFile(filePath)
+	}
+
+	api.Get("/cert/download/:type", func(c fiber.Ctx) error {
+		return download(c, c.Get(exportPasswordHeader))
+	})
+
+	api.Post("/cert/download/:type", func(c fiber.Ctx) error {
+		var req struct {
+			Password string `json:"password"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.Bind().JSON(&req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		return download(c, req.Password)
+	})
+
+	api.Post("/cert/import", func(c fiber.Ctx) error {
+		var req CertImportRequest
+		if err := c.Bind().JSON(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		if !app.claimLego() {
+			return c.Status(409).JSON(fiber.Map{"error": "Lego is already running"})
+		}
+		defer app.releaseLego()
+		trigger := requestTrigger(c)
+		run, err := app.importCertificate(config, &req, trigger)
+		if err != nil {
+			app.acapp.Syslog.Errorf("Certificate import failed: %s", err)
+			var verr *CertValidationError
+			if errors.As(err, &verr) {
+				return c.Status(422).JSON(errorPayload(err.Error(), err))
+			}
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		domain := primaryDomain(config)
+		app.acapp.Syslog.Infof("Imported certificate %s for %s", run.CertSerial, domain)
+
+		if !app.vapixAvailable() {
+			return c.JSON(fiber.Map{"message": "Certificate imported, install unavailable: VAPIX credentials not available"})
+		}
+		if err := app.installRecorded(domain, trigger, run); err != nil {
+			app.acapp.Syslog.Errorf("Failed to install imported certificate: %s", err)
+			return c.Status(500).JSON(errorPayload("Certificate imported, but install failed: "+err.Error(), err))
+		}
+		return c.JSON(fiber.Map{"message": "Certificate imported and installed to camera"})
+	})
+
+	api.Get("/https/ciphers", func(c fiber.Ctx) error {
+		if !app.vapixAvailable() {
+			return c.Status(503).JSON(fiber.Map{"error": "VAPIX credentials not available"})
+		}
+		ciphers, err := fetchSupportedCiphers(app.localDevice())
+		if err != nil {
+			return c.Status(502).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(ciphers)
+	})
+
+	api.Post("/https/apply", func(c fiber.Ctx) error {
+		if !app.vapixAvailable() {
+			return c.Status(503).JSON(fiber.Map{"error": "VAPIX credentials not available"})
+		}
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		if err := applyHTTPSPolicy(app.localDevice(), HTTPSPolicyFromConfig(config)); err != nil {
+			app.acapp.Syslog.Errorf("Failed to apply HTTPS policy: %s", err)
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		app.acapp.Syslog.Info("HTTPS policy applied")
+		return c.JSON(fiber.Map{"message": "HTTPS policy applied and verified"})
+	})
+
+	api.Get("/camera/certs", func(c fiber.Ctx) error {
+		if !app.vapixAvailable() {
+			return c.Status(503).JSON(fiber.Map{"error": "VAPIX credentials not available"})
+		}
+		inventory, err := getCameraCertInventory(app.localDevice())
+		if err != nil {
+			return c.Status(502).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(inventory)
+	})
+
+	api.Delete("/camera/certs/:id", func(c fiber.Ctx) error {
+		if !app.vapixAvailable() {
+			return c.Status(503).JSON(fiber.Map{"error": "VAPIX credentials not available"})
+		}
+		id := c.Params("id")
+		if err := deleteCameraCert(app.localDevice(), id); err != nil {
+			switch {
+			case errors.Is(err, errCameraCertNotFound):
+				return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+			case errors.Is(err, errCameraCertProtected):
+				return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+			}
+			return c.Status(502).JSON(fiber.Map{"error": err.Error()})
+		}
+		app.acapp.Syslog.Infof("Deleted certificate %s from camera", id)
+		return c.JSON(fiber.Map{"message": "Certificate deleted"})
+	})
+
+	api.Get("/devices", func(c fiber.Ctx) error {
+		devices, err := GetRemoteDevices(app.db)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		for i := range devices {
+			devices[i] = devices[i].redacted()
+		}
+		return c.JSON(devices)
+	})
+
+	api.Post("/devices", func(c fiber.Ctx) error {
+		var device RemoteDevice
+		if err := c.Bind().JSON(&device); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := validateRemoteDevice(&device, config); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		device.ID = 0
+		device.LastPushAt, device.LastStatus, device.LastError, device.LastSerial = nil, "", "", ""
+		if err := app.db.Create(&device).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(device.redacted())
+	})
+
+	api.Put("/devices/:id", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid device ID"})
+		}
+		existing, err := GetRemoteDevice(app.db, uint(id))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Device not found"})
+		}
+		var device RemoteDevice
+		if err := c.Bind().JSON(&device); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := validateRemoteDevice(&device, config); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		// Password is write-only, keep the stored one unless a new one is sent
+		if device.Password == "" {
+			device.Password = existing.Password
+		}
+		device.ID, device.CreatedAt = existing.ID, existing.CreatedAt
+		device.LastPushAt, device.LastStatus, device.LastError, device.LastSerial =
+			existing.LastPushAt, existing.LastStatus, existing.LastError, existing.LastSerial
+		if err := app.db.Save(&device).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(device.redacted())
+	})
+
+	api.Delete("/devices/:id", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid device ID"})
+		}
+		if err := app.db.Delete(&RemoteDevice{}, id).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Device deleted"})
+	})
+
+	api.Post("/devices/:id/push", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid device ID"})
+		}
+		device, err := GetRemoteDevice(app.db, uint(id))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Device not found"})
+		}
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		app.pushMu.Lock()
+		err = app.pushToDevice(config, device)
+		app.pushMu.Unlock()
+		if err != nil {
+			var verr *CertValidationError
+			if errors.As(err, &verr) {
+				return c.Status(422).JSON(errorPayload(err.Error(), err))
+			}
+			return c.Status(502).JSON(errorPayload(err.Error(), err))
+		}
+		return c.JSON(device.redacted())
+	})
+
+	api.Get("/hooks", func(c fiber.Ctx) error {
+		hooks, err := GetDeployHooks(app.db)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		for i := range hooks {
+			hooks[i] = hooks[i].redacted()
+		}
+		return c.JSON(hooks)
+	})
+
+	api.Post("/hooks", func(c fiber.Ctx) error {
+		var hook DeployHook
+		if err := c.Bind().JSON(&hook); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := validateDeployHook(&hook); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		hook.ID = 0
+		hook.LastRunAt, hook.LastStatus, hook.LastError = nil, "", ""
+		if err := app.db.Create(&hook).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(hook.redacted())
+	})
+
+	api.Put("/hooks/:id", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid hook ID"})
+		}
+		existing, err := GetDeployHook(app.db, uint(id))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Hook not found"})
+		}
+		var hook DeployHook
+		if err := c.Bind().JSON(&hook); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := validateDeployHook(&hook); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		// Secrets are write-only, keep the stored ones unless new ones are sent
+		if hook.Secret == "" {
+			hook.Secret = existing.Secret
+		}
+		if hook.ExportPassword == "" {
+			hook.ExportPassword = existing.ExportPassword
+		}
+		hook.ID, hook.CreatedAt = existing.ID, existing.CreatedAt
+		hook.LastRunAt, hook.LastStatus, hook.LastError = existing.LastRunAt, existing.LastStatus, existing.LastError
+		if err := app.db.Save(&hook).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(hook.redacted())
+	})
+
+	api.Delete("/hooks/:id", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid hook ID"})
+		}
+		if err := app.db.Delete(&DeployHook{}, id).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		hook := DeployHook{ID: uint(id)}
+		if err := os.Remove(hook.scriptPath()); err != nil && !os.IsNotExist(err) {
+			app.acapp.Syslog.Errorf("Failed to remove hook script: %s", err)
+		}
+		return c.JSON(fiber.Map{"message": "Hook deleted"})
+	})
+
+	api.Put("/hooks/:id/script", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid hook ID"})
+		}
+		hook, err := GetDeployHook(app.db, uint(id))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Hook not found"})
+		}
+		if hook.Type == HookHTTP {
+			return c.Status(400).JSON(fiber.Map{"error": "HTTP hooks have no script"})
+		}
+		if err := saveHookScript(hook, c.Body()); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(hook.redacted())
+	})
+
+	api.Post("/hooks/:id/run", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid hook ID"})
+		}
+		hook, err := GetDeployHook(app.db, uint(id))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Hook not found"})
+		}
+		if hook.Type == HookLego {
+			return c.Status(400).JSON(fiber.Map{"error": "Lego hooks only run as part of obtain and renew"})
+		}
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		if !app.hookMu.TryLock() {
+			return c.Status(409).JSON(fiber.Map{"error": "Deploy hooks are already running"})
+		}
+		err = app.runDeployHook(hook, hook.On, primaryDomain(config), requestTrigger(c), nil)
+		app.hookMu.Unlock()
+		if err != nil {
+			return c.Status(502).JSON(fiber.Map{"error": err.Error(), "hook": hook.redacted()})
+		}
+		return c.JSON(hook.redacted())
+	})
+
+	api.Get("/cert/archive", func(c fiber.Ctx) error {
+		entries, err := GetArchivedCerts(app.db)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(entries)
+	})
+
+	api.Post("/cert/archive/:id/install", func(c fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid archive ID"})
+		}
+		if !app.vapixAvailable() {
+			return c.Status(503).JSON(fiber.Map{"error": "VAPIX credentials not available"})
+		}
+		if !app.claimLego() {
+			return c.Status(409).JSON(fiber.Map{"error": "Lego is already running"})
+		}
+		defer app.releaseLego()
+		config, err := GetConfig(app.db)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "No config found"})
+		}
+		entry, err := app.rollbackCertificate(config, uint(id), requestTrigger(c))
+		if err != nil {
+			app.acapp.Syslog.Errorf("Rollback to archived certificate %d failed: %s", id, err)
+			var verr *CertValidationError
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				return c.Status(404).JSON(fiber.Map{"error": "Archived certificate not found"})
+			case errors.As(err, &verr):
+				return c.Status(422).JSON(errorPayload(err.Error(), err))
+			}
+			app.wsHub.Broadcast(MsgLegoError, errorPayload("Rollback failed: "+err.Error(), err))
+			return c.Status(500).JSON(errorPayload(err.Error(), err))
+		}
+		app.acapp.Syslog.Infof("Rolled back to archived certificate %s for %s", entry.Serial, entry.Domain)
+		return c.JSON(fiber.Map{"message": "Archived certificate installed to camera", "serial": entry.Serial})
 	})
 
 	api.Post("/cert/install", func(c fiber.Ctx) error {
-		if !app.vapixReady {
+		if !app.vapixAvailable() {
 			return c.Status(500).JSON(fiber.Map{"error": "VAPIX credentials not available"})
 		}
 		config, err := GetConfig(app.db)
@@ -377,9 +1028,20 @@ func (app *LegoApplication) setupRoutes(httpBase, wsBase string) {
 		}
 		domain := primaryDomain(config)
 
+		// Link the install to the last lego run unless that run was already installed
+		var legoRun *RunHistory
+		if last, err := GetLastLegoRun(app.db); err == nil && last.InstallRunID == nil {
+			legoRun = last
+		}
+
 		app.acapp.Syslog.Infof("Installing certificate for %s to camera", domain)
-		if err := InstallCertToCamera(app.vapixUser, app.vapixPass, domain); err != nil {
+		if err := app.installRecorded(domain, requestTrigger(c), legoRun); err != nil {
 			app.acapp.Syslog.Errorf("Failed to install certificate: %s", err)
+			app.wsHub.Broadcast(MsgLegoError, errorPayload("Install failed: "+err.Error(), err))
+			var verr *CertValidationError
+			if errors.As(err, &verr) {
+				return c.Status(422).JSON(errorPayload(err.Error(), err))
+			}
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
 		app.acapp.Syslog.Infof("Certificate for %s installed successfully", domain)
@@ -414,16 +1076,21 @@ func primaryDomain(config *Config) string {
 	return config.Domains
 }
 
-func getCertDaysRemaining(certPath string) (int, error) {
+// loadCertificate parses the first PEM certificate in certPath.
+func loadCertificate(certPath string) (*x509.Certificate, error) {
 	data, err := os.ReadFile(certPath)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	block, _ := pem.Decode(data)
 	if block == nil {
-		return 0, fmt.Errorf("failed to decode certificate PEM")
+		return nil, fmt.Errorf("failed to decode certificate PEM")
 	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func getCertDaysRemaining(certPath string) (int, error) {
+	cert, err := loadCertificate(certPath)
 	if err != nil {
 		return 0, err
 	}
@@ -431,15 +1098,7 @@ func getCertDaysRemaining(certPath string) (int, error) {
 }
 
 func parseCertInfo(certPath string) (map[string]any, error) {
-	data, err := os.ReadFile(certPath)
-	if err != nil {
-		return nil, err
-	}
-	block, _ := pem.Decode(data)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode certificate PEM")
-	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+	cert, err := loadCertificate(certPath)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	legoArchivePath = "./localdata/archive"
+	// archiveSourceExisting marks certificates archived without a run, e.g.
+	// ones obtained before the archive existed.
+	archiveSourceExisting = "existing"
+)
+
+// archivedFiles are the lego files kept per archived certificate. Only .crt and
+// .key are required, the others are archived when present.
+var archivedFiles = []string{".crt", ".key", ".issuer.crt", ".json"}
+
+// ArchivedCert is a certificate version kept in the local archive, so that a
+// bad renewal can be rolled back. The files live in <legoArchivePath>/<serial>.
+type ArchivedCert struct {
+	ID                uint      `gorm:"primarykey" json:"id"`
+	CreatedAt         time.Time `json:"created_at"`
+	Domain            string    `json:"domain"`
+	Serial            string    `gorm:"uniqueIndex" json:"serial"`
+	Issuer            string    `json:"issuer"`
+	DNSNames          string    `json:"dns_names"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+	// Source is the run history command that produced the certificate.
+	Source string `json:"source"`
+	RunID  *uint  `json:"run_id"`
+	// Valid is computed when listing: the certificate can be reinstalled now.
+	Valid bool `gorm:"-" json:"valid"`
+}
+
+func archiveDir(serial string) string {
+	return filepath.Join(legoArchivePath, serial)
+}
+
+// GetArchivedCerts returns all archived certificates, newest first.
+func GetArchivedCerts(db *gorm.DB) ([]ArchivedCert, error) {
+	var entries []ArchivedCert
+	if err := db.Order("id desc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range entries {
+		entries[i].Valid = now.After(entries[i].NotBefore) && now.Before(entries[i].NotAfter)
+	}
+	return entries, nil
+}
+
+func GetArchivedCert(db *gorm.DB, id uint) (*ArchivedCert, error) {
+	var entry ArchivedCert
+	if err := db.First(&entry, id).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// archiveCurrentCert copies the certificate files of domain into the archive.
+// A certificate already archived under the same serial is returned as is.
+func archiveCurrentCert(db *gorm.DB, domain, source string, runID *uint) (*ArchivedCert, error) {
+	cert, err := loadCertificate(legoCertPath(domain, ".crt"))
+	if err != nil {
+		return nil, err
+	}
+	serial := cert.SerialNumber.String()
+
+	var existing ArchivedCert
+	if err := db.Where("serial = ?", serial).Limit(1).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing.ID != 0 {
+		return &existing, nil
+	}
+
+	dir := archiveDir(serial)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	for _, ext := range archivedFiles {
+		data, err := os.ReadFile(legoCertPath(domain, ext))
+		if err != nil {
+			if os.IsNotExist(err) && ext != ".crt" && ext != ".key" {
+				continue
+			}
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to archive %s%s: %w", domain, ext, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, domain+ext), data, 0600); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to archive %s%s: %w", domain, ext, err)
+		}
+	}
+
+	entry := &ArchivedCert{
+		Domain:            domain,
+		Serial:            serial,
+		Issuer:            cert.Issuer.String(),
+		DNSNames:          strings.Join(cert.DNSNames, ","),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		FingerprintSHA256: sha256Fingerprint(cert.Raw),
+		Source:            source,
+		RunID:             runID,
+	}
+	if err := db.Create(entry).Error; err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return entry, nil
+}
+
+// restoreArchivedCert copies the archived files of entry back into the lego
+// certificates directory, replacing the current certificate. Optional files
+// missing from the archive are removed so they can't mismatch the restored cert.
+func restoreArchivedCert(entry *ArchivedCert) error {
+	dir := archiveDir(entry.Serial)
+	for _, ext := range archivedFiles {
+		target := legoCertPath(entry.Domain, ext)
+		data, err := os.ReadFile(filepath.Join(dir, entry.Domain+ext))
+		if os.IsNotExist(err) && ext != ".crt" && ext != ".key" {
+			os.Remove(target)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archived %s%s: %w", entry.Domain, ext, err)
+		}
+		if err := os.WriteFile(target, data, 0600); err != nil {
+			return fmt.Errorf("failed to restore %s%s: %w", entry.Domain, ext, err)
+		}
+	}
+	return nil
+}
+
+// validateArchivedCert runs the install checks for hostname on an archived
+// version without touching the current certificate.
+func validateArchivedCert(entry *ArchivedCert, hostname string) error {
+	dir := archiveDir(entry.Serial)
+	cert, err := loadCertificate(filepath.Join(dir, entry.Domain+".crt"))
+	if err != nil {
+		return &CertValidationError{ValidationInvalidCert, err.Error()}
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, entry.Domain+".key"))
+	if err != nil {
+		return fmt.Errorf("failed to read archived private key: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return &CertValidationError{ValidationInvalidKey, "failed to decode archived private key PEM"}
+	}
+	pkcs8Key, err := toPKCS8(keyBlock)
+	if err != nil {
+		return &CertValidationError{ValidationInvalidKey, err.Error()}
+	}
+	return validateCertForInstall(cert, pkcs8Key, hostname)
+}
+
+// archiveRecorded archives the certificate on disk after a successful run.
+func (app *LegoApplication) archiveRecorded(domain string, run *RunHistory) {
+	if !run.Success || run.CertSerial == "" {
+		return
+	}
+	var runID *uint
+	if run.ID != 0 {
+		runID = &run.ID
+	}
+	if _, err := archiveCurrentCert(app.db, domain, run.Command, runID); err != nil {
+		app.acapp.Syslog.Errorf("Failed to archive certificate %s: %s", run.CertSerial, err)
+	}
+}
+
+// archiveExisting archives the current certificate on startup so it can be
+// rolled back to after the next renewal.
+func (app *LegoApplication) archiveExisting() {
+	config, err := GetConfig(app.db)
+	if err != nil {
+		return
+	}
+	domain := primaryDomain(config)
+	if domain == "" || !fileExists(legoCertPath(domain, ".crt")) {
+		return
+	}
+	if _, err := archiveCurrentCert(app.db, domain, archiveSourceExisting, nil); err != nil {
+		app.acapp.Syslog.Errorf("Failed to archive current certificate: %s", err)
+	}
+}
+
+// rollbackCertificate makes the archived certificate id the current one and
+// installs it to the camera. If the install fails, the previous certificate is
+// restored on disk.
+func (app *LegoApplication) rollbackCertificate(config *Config, id uint, trigger string) (*ArchivedCert, error) {
+	entry, err := GetArchivedCert(app.db, id)
+	if err != nil {
+		return nil, err
+	}
+	domain := primaryDomain(config)
+	if entry.Domain != domain {
+		return nil, &CertValidationError{ValidationHostnameMismatch,
+			fmt.Sprintf("archived certificate is for %s, configured domain is %s", entry.Domain, domain)}
+	}
+	// Same hostname as the install, so a version that would fail it is refused up front
+	hostname, err := cameraHostname(app.localDevice(), config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateArchivedCert(entry, hostname); err != nil {
+		return nil, err
+	}
+
+	// Keep the current certificate, it may predate the archive
+	previous, err := archiveCurrentCert(app.db, domain, archiveSourceExisting, nil)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to archive current certificate: %w", err)
+	}
+	if err := restoreArchivedCert(entry); err != nil {
+		return nil, err
+	}
+	if err := app.installRecordedAs("rollback", domain, trigger, nil); err != nil {
+		if previous != nil {
+			if rerr := restoreArchivedCert(previous); rerr != nil {
+				app.acapp.Syslog.Errorf("Failed to restore certificate %s: %s", previous.Serial, rerr)
+			}
+		}
+		return nil, err
+	}
+	return entry, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Cacsjep/goxis/pkg/vapix"
+)
+
+// Install backends, the API used to manage certificates and the web server
+// TLS configuration. Auto picks REST when the device offers it.
+const (
+	BackendAuto = "auto"
+	BackendSOAP = "soap"
+	BackendREST = "rest"
+)
+
+// certBackend manages the certificate stores and the web server TLS
+// configuration of a device. Certificates are DER, keys PKCS#8.
+type certBackend struct {
+	name               string
+	listCertificates   func(dev *Device) ([]certificateEntry, error)
+	listCACertificates func(dev *Device) ([]certificateEntry, error)
+	loadCertificate    func(dev *Device, id string, cert, key []byte) error
+	loadCACertificate  func(dev *Device, id string, cert []byte) error
+	deleteCertificate  func(dev *Device, id string) error
+	getWebServerTLS    func(dev *Device) (*webServerTlsConfiguration, error)
+	setWebServerTLS    func(dev *Device, c *webServerTlsConfiguration) error
+}
+
+// validateInstallBackend checks an install backend before it is saved.
+func validateInstallBackend(backend string) error {
+	switch backend {
+	case "", BackendAuto, BackendSOAP, BackendREST:
+		return nil
+	}
+	return fmt.Errorf("invalid install backend %q", backend)
+}
+
+// certs returns the certificate backend of d. Unless d.Backend forces one, it
+// is detected on first use.
+func (d *Device) certs() *certBackend {
+	if d.backend == nil {
+		d.backend, _ = selectCertBackend(d)
+	}
+	return d.backend
+}
+
+// selectCertBackend picks the backend forced by d.Backend, or REST if API
+// discovery lists the REST APIs it needs, SOAP otherwise. If discovery fails,
+// SOAP is returned with the error.
+func selectCertBackend(d *Device) (*certBackend, error) {
+	switch d.Backend {
+	case BackendSOAP:
+		return &soapBackend, nil
+	case BackendREST:
+		return &restBackend, nil
+	}
+	apis, err := discoverAPIs(d)
+	if err != nil {
+		return &soapBackend, err
+	}
+	for _, id := range restRequiredAPIs {
+		if _, ok := apis[id]; !ok {
+			return &soapBackend, nil
+		}
+	}
+	return &restBackend, nil
+}
+
+const apiDiscoveryPath = "/axis-cgi/apidiscovery.cgi"
+
+// discoverAPIs returns the APIs the device offers with their versions, from
+// the VAPIX API discovery service.
+func discoverAPIs(dev *Device) (map[string]string, error) {
+	payload, err := json.Marshal(map[string]any{"apiVersion": "1.0", "context": "lego", "method": "getApiList"})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dev.do("POST", apiDiscoveryPath, "application/json", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API discovery returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Data struct {
+			APIList []struct {
+				ID      string `json:"id"`
+				Version string `json:"version"`
+			} `json:"apiList"`
+		} `json:"data"`
+		Error *vapix.VapixError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse API discovery response: %w", err)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("API discovery error %d: %s", response.Error.Code, response.Error.Message)
+	}
+	apis := make(map[string]string)
+	for _, api := range response.Data.APIList {
+		apis[api.ID] = api.Version
+	}
+	return apis, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var restAPIs = []string{restCertAPI, restWebServerAPI, "param"}
+
+func TestSelectCertBackend(t *testing.T) {
+	tests := []struct {
+		name          string
+		override      string
+		apis          []string
+		failDiscovery bool
+		want          string
+		wantErr       bool
+		wantDiscovery bool
+	}{
+		{"auto with REST APIs", BackendAuto, restAPIs, false, BackendREST, false, true},
+		{"empty means auto", "", restAPIs, false, BackendREST, false, true},
+		{"only cert API", BackendAuto, []string{restCertAPI, "param"}, false, BackendSOAP, false, true},
+		{"no REST APIs", BackendAuto, []string{"param"}, false, BackendSOAP, false, true},
+		{"discovery fails", BackendAuto, restAPIs, true, BackendSOAP, true, true},
+		{"forced SOAP", BackendSOAP, restAPIs, false, BackendSOAP, false, false},
+		{"forced REST", BackendREST, nil, false, BackendREST, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeCamera(t, tt.apis...)
+			if tt.failDiscovery {
+				fc.fail["POST "+apiDiscoveryPath] = 500
+			}
+			backend, err := selectCertBackend(fc.device(tt.override))
+			if backend.name != tt.want {
+				t.Errorf("backend = %s, want %s", backend.name, tt.want)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := fc.called("POST " + apiDiscoveryPath); got != tt.wantDiscovery {
+				t.Errorf("discovery called = %v, want %v", got, tt.wantDiscovery)
+			}
+		})
+	}
+}
+
+func TestLocalCertBackendCache(t *testing.T) {
+	fc := newFakeCamera(t, restAPIs...)
+	app := &LegoApplication{}
+	discovery := "POST " + apiDiscoveryPath
+
+	for range 2 {
+		if got := app.localCertBackend(fc.device("")).name; got != BackendREST {
+			t.Fatalf("backend = %s, want %s", got, BackendREST)
+		}
+	}
+	if n := fc.count(discovery); n != 1 {
+		t.Fatalf("discovery called %d times, want 1", n)
+	}
+
+	// A different override is not served from the cache
+	if got := app.localCertBackend(fc.device(BackendSOAP)).name; got != BackendSOAP {
+		t.Errorf("forced backend = %s, want %s", got, BackendSOAP)
+	}
+	app.localCertBackend(fc.device(""))
+	if n := fc.count(discovery); n != 2 {
+		t.Errorf("discovery called %d times after override change, want 2", n)
+	}
+
+	// Saving the config resets it
+	app.resetCertBackend()
+	app.localCertBackend(fc.device(""))
+	if n := fc.count(discovery); n != 3 {
+		t.Errorf("discovery called %d times after reset, want 3", n)
+	}
+
+	// A failed detection falls back to SOAP without being cached
+	app.resetCertBackend()
+	fc.fail[discovery] = 500
+	if got := app.localCertBackend(fc.device("")).name; got != BackendSOAP {
+		t.Errorf("backend after failed discovery = %s, want %s", got, BackendSOAP)
+	}
+	delete(fc.fail, discovery)
+	if got := app.localCertBackend(fc.device("")).name; got != BackendREST {
+		t.Errorf("backend after recovered discovery = %s, want %s", got, BackendREST)
+	}
+}
+
+// backendCalls are calls only the given backend makes.
+var backendCalls = map[string]string{
+	BackendSOAP: "SOAP GetWebServerTlsConfiguration",
+	BackendREST: "GET " + restWebServerTLSPath,
+}
+
+// checkBackendUsed fails if dev talked to fc through the other backend.
+func checkBackendUsed(t *testing.T, fc *fakeCamera, backend string) {
+	t.Helper()
+	for name, call := range backendCalls {
+		if name != backend && fc.called(call) {
+			t.Errorf("%s backend made %s backend call %s", backend, name, call)
+		}
+	}
+	if backend == BackendSOAP && fc.calledPrefix("GET /config/rest/") {
+		t.Errorf("SOAP backend called the REST API")
+	}
+	for _, op := range []string{"GetCertificates", "LoadCertificateWithPrivateKey", "DeleteCertificates"} {
+		if backend == BackendREST && fc.called("SOAP "+op) {
+			t.Errorf("REST backend called SOAP %s", op)
+		}
+	}
+}
+
+func TestWebServerTLSRoundTrip(t *testing.T) {
+	for _, backend := range []string{BackendSOAP, BackendREST} {
+		t.Run(backend, func(t *testing.T) {
+			fc := newFakeCamera(t, restAPIs...)
+			dev := fc.device(backend)
+			set := &webServerTlsConfiguration{
+				Tls:                true,
+				ConnectionPolicies: connectionPolicies{Admin: "HttpsOnly", Operator: "HttpAndHttps", Viewer: "HttpOnly"},
+				Ciphers:            []string{"ECDHE-ECDSA-AES128-GCM-SHA256", " ECDHE-RSA-AES128-GCM-SHA256 "},
+				CertificateSet: certificateSet{
+					Certificates:        []string{" lego-1 "},
+					CACertificates:      []string{"admin-ca", "lego-ca-1"},
+					TrustedCertificates: []string{"trusted"},
+				},
+			}
+			if err := setWebServerTlsConfiguration(dev, set); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			got, err := getWebServerTlsConfiguration(dev)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			if want := set.trimmed(); !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip = %+v, want %+v", got, want)
+			}
+			checkBackendUsed(t, fc, backend)
+		})
+	}
+}
+
+// seedCamera stores an old lego certificate and intermediate no service uses,
+// a lego certificate the web server uses and an admin CA certificate.
+func seedCamera(t *testing.T, fc *fakeCamera) {
+	t.Helper()
+	old, oldKey := newTestCert(t, &x509.Certificate{DNSNames: []string{"old.example.com"}}, nil, nil)
+	bound, boundKey := newTestCert(t, &x509.Certificate{DNSNames: []string{"cam.example.com"}}, nil, nil)
+	chain := newTestChain(t, "unused.example.com")
+	fc.addCert("lego-200101000000", old, oldKey)
+	fc.addCert("lego-210101000000", bound, boundKey)
+	fc.addCA("admin-ca", chain.root)
+	fc.addCA("lego-ca-0000000000000000", chain.intermediate)
+	fc.tls.CertificateSet = certificateSet{
+		Certificates:   []string{"lego-210101000000"},
+		CACertificates: []string{"admin-ca", "lego-ca-0000000000000000"},
+	}
+}
+
+func TestInstallCertToCamera(t *testing.T) {
+	for _, backend := range []string{BackendSOAP, BackendREST} {
+		t.Run(backend, func(t *testing.T) {
+			chain := newTestChain(t, "cam.example.com")
+			writeLegoCert(t, "cam.example.com", chain)
+			fc := newFakeCamera(t, restAPIs...)
+			seedCamera(t, fc)
+
+			var steps []InstallStep
+			err := InstallCertToCamera(fc.device(backend), "cam.example.com", "cam.example.com", &HTTPSPolicy{},
+				[]string{TargetWebServer}, func(step InstallStep) { steps = append(steps, step) })
+			if err != nil {
+				t.Fatalf("install failed: %v (steps %v)", err, steps)
+			}
+
+			fc.mu.Lock()
+			tlsConfig, certs, cas := fc.tls, maps.Clone(fc.certs), sortedKeys(fc.cas)
+			fc.mu.Unlock()
+
+			bound := tlsConfig.CertificateSet.Certificates
+			if len(bound) != 1 || !strings.HasPrefix(bound[0], legoCertIDPrefix) {
+				t.Fatalf("web server bound to %v, want a new lego certificate", bound)
+			}
+			if !bytes.Equal(certs[bound[0]].der, chain.leaf.Raw) {
+				t.Errorf("bound certificate %s is not the lego certificate", bound[0])
+			}
+			intermediateID := caCertificateID(chain.intermediate)
+			if want := []string{"admin-ca", intermediateID}; !slices.Equal(tlsConfig.CertificateSet.CACertificates, want) {
+				t.Errorf("web server CA certificates = %v, want %v", tlsConfig.CertificateSet.CACertificates, want)
+			}
+			// Old managed certificates are cleaned up, the self-signed root is not uploaded
+			if got, want := sortedKeys(certs), []string{"default", bound[0]}; !slices.Equal(got, want) {
+				t.Errorf("certificates = %v, want %v", got, want)
+			}
+			if want := []string{"admin-ca", intermediateID}; !slices.Equal(cas, want) {
+				t.Errorf("CA certificates = %v, want %v", cas, want)
+			}
+			if last := steps[len(steps)-1]; last.Step != InstallStepCleanup || last.Status != StepDone {
+				t.Errorf("last step = %v, want cleanup done", last)
+			}
+			checkBackendUsed(t, fc, backend)
+		})
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestCameraCertInventory(t *testing.T) {
+	for _, backend := range []string{BackendSOAP, BackendREST} {
+		t.Run(backend, func(t *testing.T) {
+			fc := newFakeCamera(t, restAPIs...)
+			seedCamera(t, fc)
+			inventory, err := getCameraCertInventory(fc.device(backend))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inventory.Backend != backend {
+				t.Errorf("backend = %s, want %s", inventory.Backend, backend)
+			}
+			if len(inventory.BindingErrors) > 0 {
+				t.Errorf("binding errors: %v", inventory.BindingErrors)
+			}
+			want := map[string]struct {
+				ca, managed, deletable bool
+				usedBy                 []string
+			}{
+				"default":                  {false, false, false, []string{}},
+				"lego-200101000000":        {false, true, true, []string{}},
+				"lego-210101000000":        {false, true, false, []string{TargetWebServer}},
+				"admin-ca":                 {true, false, false, []string{TargetWebServer}},
+				"lego-ca-0000000000000000": {true, true, false, []string{TargetWebServer}},
+			}
+			if len(inventory.Certificates) != len(want) {
+				t.Fatalf("%d certificates listed, want %d", len(inventory.Certificates), len(want))
+			}
+			for _, c := range inventory.Certificates {
+				w, ok := want[c.ID]
+				if !ok {
+					t.Errorf("unexpected certificate %s", c.ID)
+					continue
+				}
+				if c.CA != w.ca || c.Managed != w.managed || c.Deletable != w.deletable || !slices.Equal(c.UsedBy, w.usedBy) {
+					t.Errorf("%s: ca %v managed %v deletable %v used by %v, want %v %v %v %v",
+						c.ID, c.CA, c.Managed, c.Deletable, c.UsedBy, w.ca, w.managed, w.deletable, w.usedBy)
+				}
+				if c.ParseError != "" || c.KeyType != "ec256" {
+					t.Errorf("%s: key type %q, parse error %q", c.ID, c.KeyType, c.ParseError)
+				}
+			}
+			checkBackendUsed(t, fc, backend)
+		})
+	}
+}
+
+func TestDeleteCameraCert(t *testing.T) {
+	for _, backend := range []string{BackendSOAP, BackendREST} {
+		t.Run(backend, func(t *testing.T) {
+			fc := newFakeCamera(t, restAPIs...)
+			seedCamera(t, fc)
+			fc.tls.CertificateSet.CACertificates = []string{"admin-ca"}
+			dev := fc.device(backend)
+
+			for _, id := range []string{"lego-200101000000", "lego-ca-0000000000000000"} {
+				if err := deleteCameraCert(dev, id); err != nil {
+					t.Errorf("delete %s: %v", id, err)
+				}
+			}
+			tests := []struct {
+				id   string
+				want error
+			}{
+				{"default", errCameraCertProtected},
+				{"lego-210101000000", errCameraCertProtected},
+				{"lego-missing", errCameraCertNotFound},
+			}
+			for _, tt := range tests {
+				if err := deleteCameraCert(dev, tt.id); !errors.Is(err, tt.want) {
+					t.Errorf("delete %s: error %v, want %v", tt.id, err, tt.want)
+				}
+			}
+
+			fc.mu.Lock()
+			certs, cas := sortedKeys(fc.certs), sortedKeys(fc.cas)
+			fc.mu.Unlock()
+			if want := []string{"default", "lego-210101000000"}; !slices.Equal(certs, want) {
+				t.Errorf("certificates = %v, want %v", certs, want)
+			}
+			if want := []string{"admin-ca"}; !slices.Equal(cas, want) {
+				t.Errorf("CA certificates = %v, want %v", cas, want)
+			}
+			checkBackendUsed(t, fc, backend)
+		})
+	}
+}
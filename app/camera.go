@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// cameraTLSAddr is the camera's own HTTPS server as seen from the app.
+const cameraTLSAddr = "127.0.0.1:443"
+
+// Network parameters the camera hostname is read from.
+const (
+	cameraHostNameParam   = "Network.HostName"
+	cameraDomainNameParam = "Network.DomainName"
+)
+
+// cameraHostname returns the name the camera is reached by, which the
+// installed certificate must cover: config.CameraHostname if set, otherwise
+// the host and domain name from the camera's network settings. If those don't
+// give a fully qualified name, the primary domain is used, with a wildcard
+// replaced by the camera's host name.
+func cameraHostname(dev *Device, config *Config) (string, error) {
+	if config != nil && config.CameraHostname != "" {
+		return config.CameraHostname, nil
+	}
+	host, err := getCameraParam(dev, cameraHostNameParam)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the camera hostname, set camera_hostname: %w", err)
+	}
+	host = strings.TrimSpace(host)
+	if host != "" && !strings.Contains(host, ".") {
+		// DomainName may list several search domains, the first one is the camera's
+		if domain, err := getCameraParam(dev, cameraDomainNameParam); err == nil {
+			if fields := strings.Fields(domain); len(fields) > 0 {
+				host += "." + fields[0]
+			}
+		}
+	}
+	if !strings.Contains(host, ".") && config != nil {
+		// Many cameras have no domain name and are reached by the certificate's name
+		switch domain := primaryDomain(config); {
+		case host != "" && strings.HasPrefix(domain, "*."):
+			host += domain[1:]
+		case domain != "":
+			host = domain
+		}
+	}
+	if !strings.Contains(host, ".") {
+		return "", fmt.Errorf("camera hostname %q is not fully qualified, set camera_hostname", host)
+	}
+	return host, nil
+}
+
+// fetchServedCertificate performs a TLS handshake with addr and returns the leaf
+// certificate the server presents. The chain is not verified.
+func fetchServedCertificate(addr, serverName string) (*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", addr)
+	}
+	return certs[0], nil
+}
+
+// cameraServesCert reports whether the camera's HTTPS server currently presents
+// the local lego certificate for domain.
+func cameraServesCert(domain string) (bool, error) {
+	local, err := loadCertificate(legoCertPath(domain, ".crt"))
+	if err != nil {
+		return false, err
+	}
+	served, err := fetchServedCertificate(cameraTLSAddr, domain)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(local.Raw, served.Raw), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCameraHostname(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		config  *Config
+		want    string
+		wantErr string
+	}{
+		{"configured", map[string]string{cameraHostNameParam: "axis-accc8e"},
+			&Config{Domains: "cam.example.com", CameraHostname: "door.example.com"}, "door.example.com", ""},
+		{"fully qualified host", map[string]string{cameraHostNameParam: "cam.lan.example.com"},
+			&Config{Domains: "cam.example.com"}, "cam.lan.example.com", ""},
+		{"first search domain", map[string]string{cameraHostNameParam: "cam", cameraDomainNameParam: "lan.example.com example.com"},
+			&Config{Domains: "cam.example.com"}, "cam.lan.example.com", ""},
+		{"no domain name", map[string]string{cameraHostNameParam: "axis-accc8e", cameraDomainNameParam: ""},
+			&Config{Domains: "cam.example.com,door.example.com"}, "cam.example.com", ""},
+		{"no domain name with wildcard", map[string]string{cameraHostNameParam: "axis-accc8e"},
+			&Config{Domains: "*.example.com"}, "axis-accc8e.example.com", ""},
+		{"no domain name and no domains", map[string]string{cameraHostNameParam: "axis-accc8e"},
+			&Config{}, "", "not fully qualified"},
+		{"no config", map[string]string{cameraHostNameParam: "axis-accc8e"},
+			nil, "", "not fully qualified"},
+		{"hostname unreadable", nil,
+			&Config{Domains: "cam.example.com"}, "", "failed to read the camera hostname"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeCamera(t)
+			for name, value := range tt.params {
+				fc.params[name] = value
+			}
+			got, err := cameraHostname(fc.device(BackendSOAP), tt.config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("cameraHostname() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// CertDetails is the full inspection of a single certificate.
+type CertDetails struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	Serial             string    `json:"serial"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	IsCA               bool      `json:"is_ca"`
+	DNSNames           []string  `json:"dns_names"`
+	IPAddresses        []string  `json:"ip_addresses"`
+	PublicKeyAlgorithm string    `json:"public_key_algorithm"`
+	PublicKeySize      int       `json:"public_key_size"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	KeyUsage           []string  `json:"key_usage"`
+	ExtKeyUsage        []string  `json:"ext_key_usage"`
+	FingerprintSHA1    string    `json:"fingerprint_sha1"`
+	FingerprintSHA256  string    `json:"fingerprint_sha256"`
+	// Authority Information Access and revocation endpoints
+	IssuingCertificateURLs []string `json:"issuing_certificate_urls"`
+	OCSPServers            []string `json:"ocsp_servers"`
+	CRLDistributionPoints  []string `json:"crl_distribution_points"`
+}
+
+// ChainInspection describes the leaf certificate and its chain, leaf first.
+type ChainInspection struct {
+	Certificates  []CertDetails `json:"certificates"`
+	ChainVerified bool          `json:"chain_verified"`
+	VerifyError   string        `json:"verify_error,omitempty"`
+}
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "digital_signature"},
+	{x509.KeyUsageContentCommitment, "content_commitment"},
+	{x509.KeyUsageKeyEncipherment, "key_encipherment"},
+	{x509.KeyUsageDataEncipherment, "data_encipherment"},
+	{x509.KeyUsageKeyAgreement, "key_agreement"},
+	{x509.KeyUsageCertSign, "cert_sign"},
+	{x509.KeyUsageCRLSign, "crl_sign"},
+	{x509.KeyUsageEncipherOnly, "encipher_only"},
+	{x509.KeyUsageDecipherOnly, "decipher_only"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "server_auth",
+	x509.ExtKeyUsageClientAuth:      "client_auth",
+	x509.ExtKeyUsageCodeSigning:     "code_signing",
+	x509.ExtKeyUsageEmailProtection: "email_protection",
+	x509.ExtKeyUsageTimeStamping:    "time_stamping",
+	x509.ExtKeyUsageOCSPSigning:     "ocsp_signing",
+}
+
+// sha1Fingerprint returns the SHA-1 fingerprint of der as colon-separated hex.
+func sha1Fingerprint(der []byte) string {
+	sum := sha1.Sum(der)
+	return formatFingerprint(sum[:])
+}
+
+// sha256Fingerprint returns the SHA-256 fingerprint of der as colon-separated hex.
+func sha256Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return formatFingerprint(sum[:])
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// loadCertificates parses every PEM certificate in certPath, in file order.
+func loadCertificates(certPath string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parsePEMCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	return certs, nil
+}
+
+// parsePEMCertificates parses every CERTIFICATE block in data.
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return certs, nil
+}
+
+// loadChain returns the certificates of <domain>.crt followed by any from
+// <domain>.issuer.crt that are not already part of it.
+func loadChain(domain string) ([]*x509.Certificate, error) {
+	chain, err := loadCertificates(legoCertPath(domain, ".crt"))
+	if err != nil {
+		return nil, err
+	}
+	issuers, err := loadCertificates(legoCertPath(domain, ".issuer.crt"))
+	if err != nil {
+		return chain, nil
+	}
+	for _, issuer := range issuers {
+		known := false
+		for _, c := range chain {
+			if bytes.Equal(c.Raw, issuer.Raw) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			chain = append(chain, issuer)
+		}
+	}
+	return chain, nil
+}
+
+// inspectChain inspects the local certificate chain for domain and verifies it
+// against the system roots.
+func inspectChain(domain string) (*ChainInspection, error) {
+	chain, err := loadChain(domain)
+	if err != nil {
+		return nil, err
+	}
+	inspection := &ChainInspection{}
+	for _, cert := range chain {
+		inspection.Certificates = append(inspection.Certificates, describeCertificate(cert))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{Intermediates: intermediates})
+	if err != nil {
+		inspection.VerifyError = err.Error()
+	} else {
+		inspection.ChainVerified = true
+	}
+	return inspection, nil
+}
+
+func describeCertificate(cert *x509.Certificate) CertDetails {
+	details := CertDetails{
+		Subject:                cert.Subject.String(),
+		Issuer:                 cert.Issuer.String(),
+		Serial:                 cert.SerialNumber.String(),
+		NotBefore:              cert.NotBefore,
+		NotAfter:               cert.NotAfter,
+		IsCA:                   cert.IsCA,
+		DNSNames:               cert.DNSNames,
+		PublicKeyAlgorithm:     cert.PublicKeyAlgorithm.String(),
+		PublicKeySize:          publicKeySize(cert.PublicKey),
+		SignatureAlgorithm:     cert.SignatureAlgorithm.String(),
+		FingerprintSHA1:        sha1Fingerprint(cert.Raw),
+		FingerprintSHA256:      sha256Fingerprint(cert.Raw),
+		IssuingCertificateURLs: cert.IssuingCertificateURL,
+		OCSPServers:            cert.OCSPServer,
+		CRLDistributionPoints:  cert.CRLDistributionPoints,
+	}
+	for _, ip := range cert.IPAddresses {
+		details.IPAddresses = append(details.IPAddresses, ip.String())
+	}
+	for _, ku := range keyUsageNames {
+		if cert.KeyUsage&ku.usage != 0 {
+			details.KeyUsage = append(details.KeyUsage, ku.name)
+		}
+	}
+	for _, eku := range cert.ExtKeyUsage {
+		name, ok := extKeyUsageNames[eku]
+		if !ok {
+			name = fmt.Sprintf("unknown(%d)", eku)
+		}
+		details.ExtKeyUsage = append(details.ExtKeyUsage, name)
+	}
+	return details
+}
+
+// publicKeySize returns the key size in bits, or 0 for unknown key types.
+func publicKeySize(key any) int {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	default:
+		return 0
+	}
+}
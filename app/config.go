@@ -7,27 +7,84 @@ import (
 )
 
 type Config struct {
-	ID            uint   `gorm:"primarykey" json:"id"`
-	Email         string `json:"email"`
-	Domains       string `json:"domains"`
-	DNSProvider   string `json:"dns_provider"`
-	EnvVars       string `json:"env_vars"`
-	CAServer      string `json:"ca_server"`
-	KeyType       string `json:"key_type"`
-	DNSResolvers  string `json:"dns_resolvers"`
-	EABEnabled    bool   `json:"eab_enabled"`
-	EABKID        string `json:"eab_kid"`
-	EABHMAC       string `json:"eab_hmac"`
-	AutoMode      bool `json:"auto_mode"`
-	AutoDays      int  `json:"auto_days"`
+	ID           uint   `gorm:"primarykey" json:"id"`
+	Email        string `json:"email"`
+	Domains      string `json:"domains"`
+	DNSProvider  string `json:"dns_provider"`
+	EnvVars      string `json:"env_vars"`
+	CAServer     string `json:"ca_server"`
+	KeyType      string `json:"key_type"`
+	DNSResolvers string `json:"dns_resolvers"`
+	EABEnabled   bool   `json:"eab_enabled"`
+	EABKID       string `json:"eab_kid"`
+	EABHMAC      string `json:"eab_hmac"`
+	AutoMode     bool   `json:"auto_mode"`
+	AutoDays     int    `json:"auto_days"`
+	// Auto-renew scheduler: check interval, preferred hours of day
+	// (comma-separated, empty = any) and random delay added to each check.
+	CheckIntervalHours int    `json:"check_interval_hours"`
+	CheckHours         string `json:"check_hours"`
+	CheckJitterMinutes int    `json:"check_jitter_minutes"`
+	// Drift detection: how often to compare the local certificate with the
+	// one the camera serves, and whether to reinstall on a mismatch.
+	DriftCheckMinutes  int  `json:"drift_check_minutes"`
+	DriftAutoReinstall bool `json:"drift_auto_reinstall"`
+	// Certificate Transparency monitoring against a crt.sh-compatible endpoint.
+	CTMonitorEnabled bool   `json:"ct_monitor_enabled"`
+	CTLogURL         string `json:"ct_log_url"`
+	CTCheckHours     int    `json:"ct_check_hours"`
+	// HTTPS posture enforced on install: connection policy per user group
+	// (HttpOnly, HttpsOnly or HttpAndHttps), allowed ciphers (colon-separated)
+	// and HTTP to HTTPS redirect. Empty or null keeps the camera's setting.
+	HTTPSAdminPolicy    string `json:"https_admin_policy"`
+	HTTPSOperatorPolicy string `json:"https_operator_policy"`
+	HTTPSViewerPolicy   string `json:"https_viewer_policy"`
+	HTTPSCiphers        string `json:"https_ciphers"`
+	HTTPSRedirect       *bool  `json:"https_redirect"`
+	// InstallTargets lists the camera services the certificate is installed
+	// to, comma-separated (webserver, mqtt, dot1x). Empty means the web server.
+	InstallTargets string `json:"install_targets"`
+	// InstallTargetProfiles selects the targets per certificate: a JSON object
+	// mapping the primary domain to its comma-separated targets, overriding
+	// InstallTargets.
+	InstallTargetProfiles string `json:"install_target_profiles"`
+	// InstallBackend is the API used to install certificates: auto, soap or
+	// rest. Empty means auto.
+	InstallBackend string `json:"install_backend"`
+	// CameraHostname is the name the camera is reached by, which installed
+	// certificates must cover. Empty means the camera's network hostname, or
+	// the primary domain if that isn't fully qualified.
+	CameraHostname string `json:"camera_hostname"`
 }
 
+// Run triggers recorded in RunHistory.
+const (
+	TriggerManual = "manual"
+	TriggerAuto   = "auto"
+	TriggerAPI    = "api"
+)
+
 type RunHistory struct {
-	ID        uint      `gorm:"primarykey" json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Command   string    `json:"command"`
-	Success   bool      `json:"success"`
-	Output    string    `json:"output"`
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Command     string    `json:"command"`
+	Trigger     string    `json:"trigger"`
+	Success     bool      `json:"success"`
+	ExitCode    int       `json:"exit_code"`
+	Output      string    `json:"output"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	LegoVersion string    `json:"lego_version"`
+	CAServer    string    `json:"ca_server"`
+	// Serial and expiry of the certificate on disk after the run finished.
+	CertSerial   string     `json:"cert_serial"`
+	CertNotAfter *time.Time `json:"cert_not_after"`
+	// InstallRunID links a lego run to the install attempt that followed it.
+	InstallRunID *uint `json:"install_run_id"`
+	// HookID is set for deploy hook runs, ParentRunID links them to the run
+	// that triggered them.
+	HookID      *uint `json:"hook_id"`
+	ParentRunID *uint `json:"parent_run_id"`
 }
 
 func GetConfig(db *gorm.DB) (*Config, error) {
@@ -43,14 +100,37 @@ func GetConfig(db *gorm.DB) (*Config, error) {
 		config.CAServer = "https://acme-v02.api.letsencrypt.org/directory"
 	}
 	if config.KeyType == "" {
-		config.KeyType = "ec256"
+		config.KeyType = legoDefaultKeyType
 	}
 	if config.AutoDays == 0 {
 		config.AutoDays = 30
 	}
+	if config.CheckIntervalHours == 0 {
+		config.CheckIntervalHours = defaultCheckIntervalHours
+	}
+	if config.DriftCheckMinutes == 0 {
+		config.DriftCheckMinutes = defaultDriftCheckMinutes
+	}
+	if config.CTLogURL == "" {
+		config.CTLogURL = defaultCTLogURL
+	}
+	if config.CTCheckHours == 0 {
+		config.CTCheckHours = defaultCTCheckHours
+	}
 	return &config, nil
 }
 
+// isConfigComplete reports whether config has everything lego needs to issue a certificate.
+func isConfigComplete(config *Config) bool {
+	if config.Email == "" || len(splitDomains(config.Domains)) == 0 || config.DNSProvider == "" {
+		return false
+	}
+	if config.EABEnabled && (config.EABKID == "" || config.EABHMAC == "") {
+		return false
+	}
+	return true
+}
+
 func SaveConfig(db *gorm.DB, config *Config) error {
 	if config.ID == 0 {
 		return db.Create(config).Error
@@ -65,27 +145,43 @@ func SeedDefaultConfig(db *gorm.DB) error {
 		return nil
 	}
 	return db.Create(&Config{
-		Email:         "",
-		Domains:       "",
-		EnvVars:       "{}",
-		CAServer:      "https://acme-v02.api.letsencrypt.org/directory",
-		KeyType:       "ec256",
-		DNSResolvers:  "8.8.8.8:53",
-		AutoDays:      30,
+		Email:              "",
+		Domains:            "",
+		EnvVars:            "{}",
+		CAServer:           "https://acme-v02.api.letsencrypt.org/directory",
+		KeyType:            legoDefaultKeyType,
+		DNSResolvers:       "8.8.8.8:53",
+		AutoDays:           30,
+		CheckIntervalHours: defaultCheckIntervalHours,
+		DriftCheckMinutes:  defaultDriftCheckMinutes,
+		CTLogURL:           defaultCTLogURL,
+		CTCheckHours:       defaultCTCheckHours,
 	}).Error
 }
 
-func SaveRunHistory(db *gorm.DB, command string, success bool, output string) error {
-	return db.Create(&RunHistory{
-		Command: command,
-		Success: success,
-		Output:  output,
-	}).Error
+func SaveRunHistory(db *gorm.DB, run *RunHistory) error {
+	return db.Create(run).Error
+}
+
+// LinkInstallRun records installRunID as the install attempt that followed legoRunID.
+func LinkInstallRun(db *gorm.DB, legoRunID, installRunID uint) error {
+	return db.Model(&RunHistory{}).Where("id = ?", legoRunID).Update("install_run_id", installRunID).Error
+}
+
+// GetLastLegoRun returns the most recent obtain or renew run.
+func GetLastLegoRun(db *gorm.DB) (*RunHistory, error) {
+	var run RunHistory
+	result := db.Where("command IN ?", []string{"obtain", "renew", "auto-obtain", "auto-renew"}).Order("id desc").First(&run)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &run, nil
 }
 
+// GetLastRun returns the most recent run, not counting deploy hook runs.
 func GetLastRun(db *gorm.DB) (*RunHistory, error) {
 	var run RunHistory
-	result := db.Order("id desc").First(&run)
+	result := db.Where("hook_id IS NULL").Order("id desc").First(&run)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Cacsjep/goxis/pkg/dbus"
+)
+
+// VAPIX credential states.
+const (
+	VapixCredentialsPending  = "pending"
+	VapixCredentialsReady    = "ready"
+	VapixCredentialsRetrying = "retrying"
+)
+
+const (
+	vapixRetryInitialDelay = 5 * time.Second
+	vapixRetryMaxDelay     = 5 * time.Minute
+	// vapixRequestTimeout bounds how long a request waits for a retrieval.
+	vapixRequestTimeout = 2 * time.Second
+)
+
+// dbusRetrieveVapixCredentials is the D-Bus call, replaced in tests.
+var dbusRetrieveVapixCredentials = dbus.RetrieveVapixCredentials
+
+// VapixCredentialStatus is the state of the VAPIX credentials, reported by GET /api/status.
+type VapixCredentialStatus struct {
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	RetrievedAt *time.Time `json:"retrieved_at,omitempty"`
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+}
+
+// retrieveVapixCredentials fetches the VAPIX credentials via D-Bus and stores them.
+// Use startVapixRetrieval instead, it keeps calls from overlapping.
+func (app *LegoApplication) retrieveVapixCredentials() error {
+	user, pass, err := dbusRetrieveVapixCredentials("root")
+
+	app.vapixMu.Lock()
+	defer app.vapixMu.Unlock()
+	now := time.Now()
+	app.vapixStatus.Attempts++
+	app.vapixStatus.LastAttempt = &now
+	if err != nil {
+		app.vapixStatus.LastError = err.Error()
+		if app.vapixStatus.State != VapixCredentialsReady {
+			app.vapixStatus.State = VapixCredentialsRetrying
+		}
+		return err
+	}
+	app.vapixUser, app.vapixPass = user, pass
+	app.vapixStatus.State = VapixCredentialsReady
+	app.vapixStatus.LastError = ""
+	app.vapixStatus.RetrievedAt = &now
+	app.vapixStatus.NextRetry = nil
+	return nil
+}
+
+// startVapixRetrieval starts a D-Bus retrieval in the background and returns a
+// channel closed when it is done. Concurrent callers share the running one.
+// Within vapixRetryInitialDelay of the last attempt it returns nil, unless
+// force is set, so requests can't flood D-Bus.
+func (app *LegoApplication) startVapixRetrieval(force bool) <-chan struct{} {
+	app.vapixMu.Lock()
+	defer app.vapixMu.Unlock()
+	if app.vapixRetrieving != nil {
+		return app.vapixRetrieving
+	}
+	if last := app.vapixStatus.LastAttempt; !force && last != nil && time.Since(*last) < vapixRetryInitialDelay {
+		return nil
+	}
+	done := make(chan struct{})
+	app.vapixRetrieving = done
+	go func() {
+		app.retrieveVapixCredentials()
+		app.vapixMu.Lock()
+		app.vapixRetrieving = nil
+		app.vapixMu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// awaitVapixRetrieval waits up to vapixRequestTimeout for a retrieval started
+// with startVapixRetrieval and returns the outcome of the last attempt.
+func (app *LegoApplication) awaitVapixRetrieval(done <-chan struct{}) error {
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(vapixRequestTimeout):
+			return errors.New("timed out retrieving VAPIX credentials")
+		}
+	}
+	status := app.vapixCredentialStatus()
+	if status.LastError != "" {
+		return errors.New(status.LastError)
+	}
+	if status.State != VapixCredentialsReady {
+		return errors.New("VAPIX credentials not retrieved yet")
+	}
+	return nil
+}
+
+// vapixCredentialLoop retrieves the VAPIX credentials at startup, retrying with
+// backoff while that fails, e.g. because D-Bus isn't ready yet at boot.
+func (app *LegoApplication) vapixCredentialLoop() {
+	delay := vapixRetryInitialDelay
+	for {
+		if app.vapixCredentialStatus().State == VapixCredentialsReady {
+			return
+		}
+		<-app.startVapixRetrieval(true)
+		err := app.awaitVapixRetrieval(nil)
+		if err == nil {
+			app.acapp.Syslog.Info("VAPIX credentials retrieved successfully")
+			return
+		}
+		next := time.Now().Add(delay)
+		app.vapixMu.Lock()
+		app.vapixStatus.NextRetry = &next
+		app.vapixMu.Unlock()
+		app.acapp.Syslog.Infof("Could not retrieve VAPIX credentials: %s (retrying in %s)", err, delay)
+
+		select {
+		case <-app.shutdown:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, vapixRetryMaxDelay)
+	}
+}
+
+// vapixAvailable reports whether VAPIX credentials are available. If they
+// aren't yet, it tries to retrieve them once instead of waiting for the retry
+// loop, e.g. for the first install after D-Bus failed at boot. The attempt is
+// rate-limited and waits at most vapixRequestTimeout.
+func (app *LegoApplication) vapixAvailable() bool {
+	if app.vapixCredentialStatus().State == VapixCredentialsReady {
+		return true
+	}
+	done := app.startVapixRetrieval(false)
+	if done == nil {
+		return false
+	}
+	return app.awaitVapixRetrieval(done) == nil
+}
+
+// refreshVapixCredentials fetches the credentials again after the camera
+// rejected them, e.g. because they were rotated. Concurrent rejections share
+// one retrieval, and within vapixRetryInitialDelay of the last one the current
+// credentials are returned without asking D-Bus again.
+func (app *LegoApplication) refreshVapixCredentials() (string, string, error) {
+	done := app.startVapixRetrieval(false)
+	if done != nil {
+		app.acapp.Syslog.Warnf("VAPIX credentials were rejected, retrieving them again")
+	}
+	if err := app.awaitVapixRetrieval(done); err != nil {
+		app.acapp.Syslog.Errorf("Could not retrieve VAPIX credentials: %s", err)
+		return "", "", err
+	}
+	user, pass := app.vapixCredentials()
+	return user, pass, nil
+}
+
+func (app *LegoApplication) vapixCredentials() (string, string) {
+	app.vapixMu.Lock()
+	defer app.vapixMu.Unlock()
+	return app.vapixUser, app.vapixPass
+}
+
+func (app *LegoApplication) vapixCredentialStatus() VapixCredentialStatus {
+	app.vapixMu.Lock()
+	defer app.vapixMu.Unlock()
+	return app.vapixStatus
+}
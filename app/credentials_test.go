@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDBus replaces the D-Bus call for a test, counting calls. Each call
+// waits for release if it is set.
+func fakeDBus(t *testing.T, err error, release chan struct{}) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	orig := dbusRetrieveVapixCredentials
+	dbusRetrieveVapixCredentials = func(string) (string, string, error) {
+		calls.Add(1)
+		if release != nil {
+			<-release
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return "root", "secret", nil
+	}
+	t.Cleanup(func() { dbusRetrieveVapixCredentials = orig })
+	return &calls
+}
+
+func retryingApp(lastAttempt time.Time) *LegoApplication {
+	app := &LegoApplication{}
+	app.vapixStatus.State = VapixCredentialsRetrying
+	app.vapixStatus.LastAttempt = &lastAttempt
+	return app
+}
+
+func TestVapixAvailableRetrievesOnce(t *testing.T) {
+	calls := fakeDBus(t, nil, nil)
+	app := retryingApp(time.Now().Add(-time.Minute))
+
+	if !app.vapixAvailable() {
+		t.Fatalf("vapixAvailable() = false, want the credentials retrieved: %+v", app.vapixCredentialStatus())
+	}
+	if user, pass := app.vapixCredentials(); user != "root" || pass != "secret" {
+		t.Errorf("credentials = %q, %q", user, pass)
+	}
+	if !app.vapixAvailable() || calls.Load() != 1 {
+		t.Errorf("D-Bus called %d times, want 1", calls.Load())
+	}
+}
+
+func TestVapixAvailableRateLimited(t *testing.T) {
+	calls := fakeDBus(t, errors.New("D-Bus not ready"), nil)
+	app := retryingApp(time.Now().Add(-time.Minute))
+
+	for range 3 {
+		if app.vapixAvailable() {
+			t.Fatal("vapixAvailable() = true while D-Bus fails")
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("D-Bus called %d times, want 1 within the retry delay", n)
+	}
+}
+
+func TestVapixAvailableTimeout(t *testing.T) {
+	release := make(chan struct{})
+	fakeDBus(t, nil, release)
+	app := retryingApp(time.Now().Add(-time.Minute))
+
+	start := time.Now()
+	if app.vapixAvailable() {
+		t.Fatal("vapixAvailable() = true while D-Bus hangs")
+	}
+	if elapsed := time.Since(start); elapsed > vapixRequestTimeout+time.Second {
+		t.Errorf("vapixAvailable() blocked for %s", elapsed)
+	}
+
+	// The retrieval goes on in the background and is joined, not repeated
+	done := app.startVapixRetrieval(false)
+	if done == nil {
+		t.Fatal("no retrieval running after the timeout")
+	}
+	close(release)
+	<-done
+	if !app.vapixAvailable() {
+		t.Error("credentials not available after the retrieval finished")
+	}
+}
+
+func TestVapixRetrievalSingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	calls := fakeDBus(t, nil, release)
+	app := &LegoApplication{}
+	app.vapixStatus.State = VapixCredentialsReady
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- app.awaitVapixRetrieval(app.startVapixRetrieval(false))
+		}()
+	}
+	// Let all callers join the running retrieval before it finishes
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("refresh failed: %v", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("D-Bus called %d times for concurrent refreshes, want 1", n)
+	}
+
+	// A refresh right after the last one reuses its credentials
+	if done := app.startVapixRetrieval(false); done != nil {
+		t.Error("refresh within the retry delay started a retrieval")
+	}
+}
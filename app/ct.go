@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultCTLogURL     = "https://crt.sh/"
+	defaultCTCheckHours = 24
+	// ctStartupDelay is the wait before the first check after app start.
+	ctStartupDelay = time.Minute
+)
+
+// ctLogEntry is one certificate in a crt.sh-compatible JSON search result.
+type ctLogEntry struct {
+	ID           int64  `json:"id"`
+	IssuerName   string `json:"issuer_name"`
+	CommonName   string `json:"common_name"`
+	NameValue    string `json:"name_value"`
+	SerialNumber string `json:"serial_number"`
+	NotBefore    string `json:"not_before"`
+	NotAfter     string `json:"not_after"`
+}
+
+// CTFinding is a currently valid certificate for one of our domains that this
+// app didn't obtain.
+type CTFinding struct {
+	Domain     string `json:"domain"`
+	LogID      int64  `json:"log_id"`
+	Serial     string `json:"serial"`
+	Issuer     string `json:"issuer"`
+	CommonName string `json:"common_name"`
+	Names      string `json:"names"`
+	NotBefore  string `json:"not_before"`
+	NotAfter   string `json:"not_after"`
+}
+
+// CTStatus is the result of a Certificate Transparency check.
+type CTStatus struct {
+	CheckedAt time.Time   `json:"checked_at"`
+	Domains   []string    `json:"domains"`
+	Unknown   []CTFinding `json:"unknown"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// knownSerials returns the serials of all certificates this app obtained: those
+// recorded in the run history, the archive and the current certificate files
+// of domains. Certificates obtained before runs recorded serials are only
+// known from the archive and the files.
+func knownSerials(db *gorm.DB, domains []string) (map[string]bool, error) {
+	var serials []string
+	if err := db.Model(&RunHistory{}).Where("cert_serial <> ''").Distinct().Pluck("cert_serial", &serials).Error; err != nil {
+		return nil, err
+	}
+	var archived []string
+	if err := db.Model(&ArchivedCert{}).Pluck("serial", &archived).Error; err != nil {
+		return nil, err
+	}
+	serials = append(serials, archived...)
+	for _, domain := range domains {
+		if cert, err := loadCertificate(legoCertPath(domain, ".crt")); err == nil {
+			serials = append(serials, cert.SerialNumber.String())
+		}
+	}
+	known := make(map[string]bool, len(serials))
+	for _, s := range serials {
+		known[s] = true
+	}
+	return known, nil
+}
+
+// queryCTLog searches the CT log endpoint for certificates covering domain.
+func queryCTLog(endpoint, domain string) ([]ctLogEntry, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CT log URL: %w", err)
+	}
+	// crt.sh uses % as wildcard
+	q := u.Query()
+	q.Set("q", strings.Replace(domain, "*", "%", 1))
+	q.Set("output", "json")
+	u.RawQuery = q.Encode()
+
+	resp, err := httpAPIClient.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("CT log query failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CT log query returned status %d", resp.StatusCode)
+	}
+
+	var entries []ctLogEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to parse CT log response: %w", err)
+	}
+	return entries, nil
+}
+
+// ctNotAfter parses the not_after timestamp of a crt.sh entry.
+func ctNotAfter(entry ctLogEntry) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.Parse(layout, entry.NotAfter); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid not_after %q", entry.NotAfter)
+}
+
+// checkCT queries the CT log for every configured domain and flags currently
+// valid certificates whose serial is not in the run history.
+func (app *LegoApplication) checkCT(config *Config) *CTStatus {
+	status := &CTStatus{CheckedAt: time.Now(), Domains: splitDomains(config.Domains)}
+	defer app.setLastCT(status)
+
+	known, err := knownSerials(app.db, []string{primaryDomain(config)})
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	seen := make(map[string]bool)
+	for _, domain := range status.Domains {
+		entries, err := queryCTLog(config.CTLogURL, domain)
+		if err != nil {
+			status.Error = err.Error()
+			return status
+		}
+		for _, entry := range entries {
+			notAfter, err := ctNotAfter(entry)
+			if err != nil || notAfter.Before(status.CheckedAt) {
+				continue
+			}
+			// crt.sh reports serials as hex, the run history stores them in decimal
+			serial, ok := new(big.Int).SetString(entry.SerialNumber, 16)
+			if !ok || known[serial.String()] || seen[serial.String()] {
+				continue
+			}
+			seen[serial.String()] = true
+			status.Unknown = append(status.Unknown, CTFinding{
+				Domain:     domain,
+				LogID:      entry.ID,
+				Serial:     serial.String(),
+				Issuer:     entry.IssuerName,
+				CommonName: entry.CommonName,
+				Names:      entry.NameValue,
+				NotBefore:  entry.NotBefore,
+				NotAfter:   entry.NotAfter,
+			})
+		}
+	}
+
+	if len(status.Unknown) > 0 {
+		app.acapp.Syslog.Warnf("Certificate Transparency: %d certificate(s) for our domains not obtained by this app",
+			len(status.Unknown))
+		app.wsHub.Broadcast(MsgCTUnknown, status)
+	}
+	return status
+}
+
+func (app *LegoApplication) setLastCT(status *CTStatus) {
+	app.ctMu.Lock()
+	defer app.ctMu.Unlock()
+	app.lastCT = status
+}
+
+func (app *LegoApplication) getLastCT() *CTStatus {
+	app.ctMu.Lock()
+	defer app.ctMu.Unlock()
+	return app.lastCT
+}
+
+// ctLoop runs checkCT shortly after startup and then periodically, while CT
+// monitoring is enabled.
+func (app *LegoApplication) ctLoop() {
+	check := func() {
+		if config, err := GetConfig(app.db); err == nil && config.CTMonitorEnabled && config.Domains != "" {
+			app.checkCT(config)
+		}
+	}
+	select {
+	case <-app.shutdown:
+		return
+	case <-time.After(ctStartupDelay):
+		check()
+	}
+	app.runEvery(func() time.Duration {
+		if config, err := GetConfig(app.db); err == nil {
+			return time.Duration(config.CTCheckHours) * time.Hour
+		}
+		return defaultCTCheckHours * time.Hour
+	}, check)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cacsjep/goxis/pkg/vapix"
+)
+
+// Device is an Axis device reachable over VAPIX: the camera this app runs on,
+// or a remote device certificates are pushed to.
+type Device struct {
+	BaseURL  string
+	Username string
+	Password string
+	// TLSAddr is host:port of the device's HTTPS server, used to verify the
+	// certificate it presents.
+	TLSAddr string
+	// Backend forces the install backend, empty or auto detects it.
+	Backend string
+	backend *certBackend
+	client  *http.Client
+	// refresh returns new credentials after the device rejected the current
+	// ones. Nil if they can't change.
+	refresh func() (username, password string, err error)
+}
+
+// localDevice returns the camera this app runs on, using the internal VAPIX endpoint.
+func (app *LegoApplication) localDevice() *Device {
+	username, password := app.vapixCredentials()
+	dev := &Device{
+		BaseURL:  vapix.INTERNAL_VAPIX_ENDPOINT,
+		Username: username,
+		Password: password,
+		TLSAddr:  cameraTLSAddr,
+		client:   httpSOAPClient,
+		refresh:  app.refreshVapixCredentials,
+	}
+	if config, err := GetConfig(app.db); err == nil {
+		dev.Backend = config.InstallBackend
+	}
+	dev.backend = app.localCertBackend(dev)
+	return dev
+}
+
+// localCertBackend returns the certificate backend of the camera, detected
+// once per backend override. A failed detection falls back to SOAP without
+// being cached, so it is tried again on the next request.
+func (app *LegoApplication) localCertBackend(dev *Device) *certBackend {
+	app.backendMu.Lock()
+	defer app.backendMu.Unlock()
+	if app.backend != nil && app.backendFor == dev.Backend {
+		return app.backend
+	}
+	backend, err := selectCertBackend(dev)
+	if err != nil {
+		return backend
+	}
+	app.backend, app.backendFor = backend, dev.Backend
+	return backend
+}
+
+// resetCertBackend makes the next request detect the backend again, e.g.
+// after the config was saved.
+func (app *LegoApplication) resetCertBackend() {
+	app.backendMu.Lock()
+	defer app.backendMu.Unlock()
+	app.backend = nil
+}
+
+// newRemoteDevice returns a device reached over HTTPS at host. skipVerify
+// accepts any server certificate, needed until the device serves a trusted one.
+func newRemoteDevice(host, username, password string, skipVerify bool) *Device {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: skipVerify}
+	tlsAddr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		tlsAddr = net.JoinHostPort(host, "443")
+	}
+	return &Device{
+		BaseURL:  "https://" + host,
+		Username: username,
+		Password: password,
+		TLSAddr:  tlsAddr,
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+// do sends a request to path. It authenticates with basic auth and falls back
+// to digest auth when the device asks for it. If the credentials are rejected
+// and can be refreshed, the request is retried once with new ones. The caller
+// closes the body.
+func (d *Device) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	resp, err := d.doAuthenticated(method, path, contentType, body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || d.refresh == nil {
+		return resp, err
+	}
+	username, password, rerr := d.refresh()
+	if rerr != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	d.Username, d.Password = username, password
+	return d.doAuthenticated(method, path, contentType, body)
+}
+
+func (d *Device) doAuthenticated(method, path, contentType string, body []byte) (*http.Response, error) {
+	send := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequest(method, d.BaseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		} else {
+			req.SetBasicAuth(d.Username, d.Password)
+		}
+		return d.client.Do(req)
+	}
+
+	resp, err := send("")
+	if err != nil {
+		return nil, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(challenge, "Digest ") {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	authorization, err := d.digestAuthorization(challenge, method, path)
+	if err != nil {
+		return nil, err
+	}
+	return send(authorization)
+}
+
+// digestAuthorization answers an RFC 7616 digest challenge with qop=auth.
+func (d *Device) digestAuthorization(challenge, method, path string) (string, error) {
+	params := parseDigestChallenge(strings.TrimPrefix(challenge, "Digest "))
+	var newHash func() hash.Hash
+	switch strings.ToUpper(params["algorithm"]) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %s", params["algorithm"])
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	uri := path
+	if u, err := url.Parse(path); err == nil {
+		uri = u.RequestURI()
+	}
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+	const nc = "00000001"
+
+	ha1 := h(d.Username + ":" + params["realm"] + ":" + d.Password)
+	ha2 := h(method + ":" + uri)
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		d.Username, params["realm"], params["nonce"], uri)
+	if strings.Contains(params["qop"], "auth") {
+		response := h(ha1 + ":" + params["nonce"] + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, h(ha1+":"+params["nonce"]+":"+ha2))
+	}
+	if params["algorithm"] != "" {
+		header += ", algorithm=" + params["algorithm"]
+	}
+	if params["opaque"] != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, params["opaque"])
+	}
+	return header, nil
+}
+
+// parseDigestChallenge splits key="value" pairs, honoring commas inside quotes.
+func parseDigestChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+const defaultDriftCheckMinutes = 60
+
+// DriftStatus is the result of comparing the local certificate with the one the camera serves.
+type DriftStatus struct {
+	CheckedAt         time.Time `json:"checked_at"`
+	InSync            bool      `json:"in_sync"`
+	LocalSerial       string    `json:"local_serial,omitempty"`
+	LocalFingerprint  string    `json:"local_fingerprint,omitempty"`
+	CameraSerial      string    `json:"camera_serial,omitempty"`
+	CameraFingerprint string    `json:"camera_fingerprint,omitempty"`
+	// Source tells how the camera certificate was read: "tls" or "vapix".
+	Source      string `json:"source,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Reinstalled bool   `json:"reinstalled"`
+}
+
+// fetchCameraCertificate returns the certificate the camera's web server uses.
+// It tries a TLS handshake first and falls back to reading the active certificate via VAPIX.
+func (app *LegoApplication) fetchCameraCertificate(domain string) (*x509.Certificate, string, error) {
+	cert, tlsErr := fetchServedCertificate(cameraTLSAddr, domain)
+	if tlsErr == nil {
+		return cert, "tls", nil
+	}
+	if !app.vapixAvailable() {
+		return nil, "", tlsErr
+	}
+	certID, err := getActiveCertificateID(app.localDevice())
+	if err != nil {
+		return nil, "", fmt.Errorf("%s; VAPIX lookup failed: %w", tlsErr, err)
+	}
+	cert, err = getCameraCertificate(app.localDevice(), certID)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s; VAPIX lookup failed: %w", tlsErr, err)
+	}
+	return cert, "vapix", nil
+}
+
+// checkDrift compares the local certificate with the camera's active certificate.
+// On a mismatch it reinstalls the local certificate if enabled in config.
+func (app *LegoApplication) checkDrift(config *Config) *DriftStatus {
+	status := &DriftStatus{CheckedAt: time.Now()}
+	defer app.setLastDrift(status)
+
+	domain := primaryDomain(config)
+	local, err := loadCertificate(legoCertPath(domain, ".crt"))
+	if err != nil {
+		status.Error = "no local certificate"
+		return status
+	}
+	status.LocalSerial = local.SerialNumber.String()
+	status.LocalFingerprint = sha256Fingerprint(local.Raw)
+
+	camera, source, err := app.fetchCameraCertificate(domain)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Source = source
+	status.CameraSerial = camera.SerialNumber.String()
+	status.CameraFingerprint = sha256Fingerprint(camera.Raw)
+	status.InSync = bytes.Equal(local.Raw, camera.Raw)
+	if status.InSync {
+		return status
+	}
+
+	app.acapp.Syslog.Warnf("Camera serves certificate %s, local certificate is %s",
+		status.CameraSerial, status.LocalSerial)
+	app.wsHub.Broadcast(MsgCertDrift, status)
+
+	if !config.DriftAutoReinstall || !app.vapixAvailable() {
+		return status
+	}
+	if now := time.Now(); now.Before(local.NotBefore) || now.After(local.NotAfter) {
+		app.acapp.Syslog.Infof("Not reinstalling: local certificate is not currently valid")
+		return status
+	}
+	if !app.claimLego() {
+		app.acapp.Syslog.Infof("Not reinstalling: lego is running")
+		return status
+	}
+	defer app.releaseLego()
+	app.acapp.Syslog.Infof("Reinstalling local certificate for %s", domain)
+	if err := app.installRecorded(domain, TriggerAuto, nil); err != nil {
+		app.acapp.Syslog.Errorf("Drift reinstall failed: %s", err)
+		status.Error = "reinstall failed: " + err.Error()
+	} else {
+		status.Reinstalled = true
+	}
+	app.wsHub.Broadcast(MsgCertDrift, status)
+	return status
+}
+
+func (app *LegoApplication) setLastDrift(status *DriftStatus) {
+	app.driftMu.Lock()
+	defer app.driftMu.Unlock()
+	app.lastDrift = status
+}
+
+func (app *LegoApplication) getLastDrift() *DriftStatus {
+	app.driftMu.Lock()
+	defer app.driftMu.Unlock()
+	return app.lastDrift
+}
+
+// driftLoop periodically runs checkDrift.
+func (app *LegoApplication) driftLoop() {
+	app.runEvery(func() time.Duration {
+		if config, err := GetConfig(app.db); err == nil {
+			return time.Duration(config.DriftCheckMinutes) * time.Minute
+		}
+		return defaultDriftCheckMinutes * time.Minute
+	}, func() {
+		if config, err := GetConfig(app.db); err == nil && primaryDomain(config) != "" {
+			app.checkDrift(config)
+		}
+	})
+}
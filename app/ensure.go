@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Ensure actions, decided from the local certificate state.
+const (
+	EnsureObtain  = "obtain"
+	EnsureReissue = "reissue"
+	EnsureRenew   = "renew"
+	EnsureNone    = "none"
+)
+
+// EnsureResult describes what an ensure operation decided and did.
+type EnsureResult struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	// Imported is set for certificates imported via /api/cert/import. Lego
+	// can't renew them, so Expiring asks the user to import a renewed one.
+	Imported bool `json:"imported"`
+	Expiring bool `json:"expiring"`
+	// Run is the lego run executed for the action, nil for EnsureNone.
+	Run       *RunHistory `json:"run,omitempty"`
+	Installed bool        `json:"installed"`
+	// InstallNote explains why no install happened, if so.
+	InstallNote string `json:"install_note,omitempty"`
+}
+
+// decideEnsure inspects the certificate on disk and decides whether it needs
+// to be obtained, reissued, renewed or left alone.
+func decideEnsure(db *gorm.DB, config *Config) *EnsureResult {
+	domain := primaryDomain(config)
+	certFile := legoCertPath(domain, ".crt")
+	if !fileExists(certFile) {
+		return &EnsureResult{Action: EnsureObtain, Reason: "no certificate on disk"}
+	}
+	cert, err := loadCertificate(certFile)
+	if err != nil {
+		return &EnsureResult{Action: EnsureObtain, Reason: fmt.Sprintf("certificate unreadable: %s", err)}
+	}
+	if isImportedCert(db, cert.SerialNumber.String()) {
+		return decideImported(certFile, config)
+	}
+	if !sameDomains(cert.DNSNames, splitDomains(config.Domains)) {
+		return &EnsureResult{
+			Action: EnsureReissue,
+			Reason: fmt.Sprintf("certificate covers %s, config lists %s", strings.Join(cert.DNSNames, ","), config.Domains),
+		}
+	}
+	wantKeyType := config.KeyType
+	if wantKeyType == "" {
+		wantKeyType = legoDefaultKeyType
+	}
+	if keyType := certKeyType(cert); keyType != wantKeyType {
+		return &EnsureResult{
+			Action: EnsureReissue,
+			Reason: fmt.Sprintf("certificate key type is %s, config wants %s", keyType, wantKeyType),
+		}
+	}
+	days, _ := getCertDaysRemaining(certFile)
+	if days <= config.AutoDays {
+		return &EnsureResult{
+			Action: EnsureRenew,
+			Reason: fmt.Sprintf("certificate expires in %d days (threshold: %d)", days, config.AutoDays),
+		}
+	}
+	return &EnsureResult{
+		Action: EnsureNone,
+		Reason: fmt.Sprintf("certificate valid for %d more days (threshold: %d)", days, config.AutoDays),
+	}
+}
+
+// decideImported never replaces an imported certificate, it only reports
+// when it is about to expire.
+func decideImported(certFile string, config *Config) *EnsureResult {
+	days, _ := getCertDaysRemaining(certFile)
+	if days <= config.AutoDays {
+		return &EnsureResult{
+			Action:   EnsureNone,
+			Imported: true,
+			Expiring: true,
+			Reason:   fmt.Sprintf("imported certificate expires in %d days (threshold: %d), import a renewed one", days, config.AutoDays),
+		}
+	}
+	return &EnsureResult{
+		Action:   EnsureNone,
+		Imported: true,
+		Reason:   fmt.Sprintf("imported certificate valid for %d more days (threshold: %d)", days, config.AutoDays),
+	}
+}
+
+// sameDomains compares two domain lists ignoring order and case.
+func sameDomains(a, b []string) bool {
+	normalize := func(list []string) []string {
+		out := make([]string, 0, len(list))
+		for _, d := range list {
+			out = append(out, strings.ToLower(d))
+		}
+		slices.Sort(out)
+		return slices.Compact(out)
+	}
+	return slices.Equal(normalize(a), normalize(b))
+}
+
+// certKeyType returns the lego --key-type name matching the certificate's public key.
+func certKeyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ec%d", key.Curve.Params().BitSize)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", key.N.BitLen())
+	default:
+		return "unknown"
+	}
+}
+
+// errLegoBusy is returned when lego can't start because another run holds the claim.
+var errLegoBusy = errors.New("lego is already running")
+
+// claimLego claims the single lego run slot. Every caller of runLegoRecorded
+// and applyEnsure holds the claim, so two runs can't overwrite each other's
+// process state or certificate files. It returns false if the slot is taken.
+func (app *LegoApplication) claimLego() bool {
+	app.legoMu.Lock()
+	defer app.legoMu.Unlock()
+	if app.legoBusy || IsLegoRunning() {
+		return false
+	}
+	app.legoBusy = true
+	return true
+}
+
+// releaseLego frees the slot taken by claimLego.
+func (app *LegoApplication) releaseLego() {
+	app.legoMu.Lock()
+	defer app.legoMu.Unlock()
+	app.legoBusy = false
+}
+
+// startEnsure decides what the certificate needs and applies it in the
+// background, holding the lego claim until it is done.
+func (app *LegoApplication) startEnsure(config *Config, trigger string) (*EnsureResult, error) {
+	if !app.claimLego() {
+		return nil, errLegoBusy
+	}
+	result := decideEnsure(app.db, config)
+	go func() {
+		defer app.releaseLego()
+		if _, err := app.applyEnsure(config, result, trigger); err != nil {
+			app.acapp.Syslog.Errorf("Ensure failed: %s", err)
+		}
+	}()
+	return result, nil
+}
+
+// applyEnsure runs the lego command for the decided action, then installs the
+// certificate unless the camera already serves it. The caller holds the lego claim.
+func (app *LegoApplication) applyEnsure(config *Config, result *EnsureResult, trigger string) (*EnsureResult, error) {
+	domain := primaryDomain(config)
+	app.acapp.Syslog.Infof("Ensure for %s: %s (%s)", domain, result.Action, result.Reason)
+	if result.Expiring {
+		app.acapp.Syslog.Warnf("Certificate for %s: %s", domain, result.Reason)
+		app.wsHub.Broadcast(MsgCertExpiring, map[string]string{"domain": domain, "message": result.Reason})
+	}
+
+	if result.Action != EnsureNone {
+		if !isConfigComplete(config) {
+			return result, fmt.Errorf("cannot %s certificate: config is incomplete", result.Action)
+		}
+		command := "renew"
+		if result.Action == EnsureObtain || result.Action == EnsureReissue {
+			command = "obtain"
+		}
+		run, err := app.runLegoRecorded(config, command, trigger)
+		result.Run = run
+		if err != nil {
+			app.wsHub.Broadcast(MsgEnsureResult, result)
+			return result, err
+		}
+	}
+
+	err := app.ensureInstalled(domain, trigger, result)
+	app.wsHub.Broadcast(MsgEnsureResult, result)
+	return result, err
+}
+
+// ensureInstalled installs the certificate for domain if the camera doesn't serve it yet.
+func (app *LegoApplication) ensureInstalled(domain, trigger string, result *EnsureResult) error {
+	if !app.vapixAvailable() {
+		result.InstallNote = "VAPIX credentials not available"
+		return nil
+	}
+	if served, err := cameraServesCert(domain); err == nil && served {
+		result.InstallNote = "camera already serves this certificate"
+		return nil
+	}
+
+	legoRun := result.Run
+	if legoRun == nil {
+		if last, err := GetLastLegoRun(app.db); err == nil && last.InstallRunID == nil {
+			legoRun = last
+		}
+	}
+
+	app.acapp.Syslog.Infof("Installing certificate for %s to camera", domain)
+	if err := app.installRecorded(domain, trigger, legoRun); err != nil {
+		app.acapp.Syslog.Errorf("Install failed: %s", err)
+		app.wsHub.Broadcast(MsgLegoError, errorPayload("Install failed: "+err.Error(), err))
+		return fmt.Errorf("install failed: %w", err)
+	}
+	result.Installed = true
+	app.acapp.Syslog.Infof("Install successful for %s", domain)
+	app.wsHub.Broadcast(MsgLegoComplete, map[string]string{"message": "Certificate installed to camera"})
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClaimLegoSingleRun(t *testing.T) {
+	app := &LegoApplication{}
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if app.claimLego() {
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := claimed.Load(); n != 1 {
+		t.Fatalf("%d concurrent claims succeeded, want 1", n)
+	}
+	app.releaseLego()
+	if !app.claimLego() {
+		t.Error("claim failed after release")
+	}
+}
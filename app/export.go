@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// exportPasswordHeader carries the PKCS#12 password of GET /api/cert/download/:type.
+const exportPasswordHeader = "X-Export-Password"
+
+// exportTypes lists the generated download formats besides the raw lego files.
+var exportTypes = []string{"fullchain", "keychain", "der", "issuer-der", "p12", "zip"}
+
+// ExportFile is a generated certificate download.
+type ExportFile struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// certBundle holds the local certificate chain and private key for domain.
+type certBundle struct {
+	domain string
+	keyPEM []byte
+	key    any
+	chain  []*x509.Certificate
+}
+
+func loadCertBundle(domain string) (*certBundle, error) {
+	chain, err := loadChain(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(legoCertPath(domain, ".key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM")
+	}
+	pkcs8Key, err := toPKCS8(keyBlock)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(pkcs8Key)
+	if err != nil {
+		return nil, err
+	}
+	return &certBundle{domain: domain, keyPEM: keyPEM, key: key, chain: chain}, nil
+}
+
+func (b *certBundle) fullchainPEM() []byte {
+	var buf bytes.Buffer
+	for _, cert := range b.chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+func (b *certBundle) keyFullchainPEM() []byte {
+	return append(append([]byte{}, b.keyPEM...), b.fullchainPEM()...)
+}
+
+// pkcs12 encodes key, leaf and chain as a password-protected PFX. Legacy
+// selects 3DES/SHA-1 encryption for older Windows and Java clients.
+func (b *certBundle) pkcs12(password string, legacy bool) ([]byte, error) {
+	encoder := pkcs12.Modern
+	if legacy {
+		encoder = pkcs12.LegacyDES
+	}
+	return encoder.Encode(b.key, b.chain[0], b.chain[1:], password)
+}
+
+// zipBundle packs every export format. The PKCS#12 file is only included when
+// a password is given.
+func (b *certBundle) zipBundle(password string, legacy bool) ([]byte, error) {
+	files := []ExportFile{
+		{Name: b.domain + ".crt", Data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b.chain[0].Raw})},
+		{Name: b.domain + ".key", Data: b.keyPEM},
+		{Name: b.domain + ".fullchain.pem", Data: b.fullchainPEM()},
+		{Name: b.domain + ".key-fullchain.pem", Data: b.keyFullchainPEM()},
+		{Name: b.domain + ".der", Data: b.chain[0].Raw},
+	}
+	if len(b.chain) > 1 {
+		files = append(files,
+			ExportFile{Name: b.domain + ".issuer.crt", Data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b.chain[1].Raw})},
+			ExportFile{Name: b.domain + ".issuer.der", Data: b.chain[1].Raw},
+		)
+	}
+	if password != "" {
+		pfx, err := b.pkcs12(password, legacy)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ExportFile{Name: b.domain + ".p12", Data: pfx})
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildExport generates the requested export format for domain.
+func buildExport(domain, fileType, password string, legacy bool) (*ExportFile, error) {
+	bundle, err := loadCertBundle(domain)
+	if err != nil {
+		return nil, err
+	}
+	switch fileType {
+	case "fullchain":
+		return &ExportFile{domain + ".fullchain.pem", "application/x-pem-file", bundle.fullchainPEM()}, nil
+	case "keychain":
+		return &ExportFile{domain + ".key-fullchain.pem", "application/x-pem-file", bundle.keyFullchainPEM()}, nil
+	case "der":
+		return &ExportFile{domain + ".der", "application/pkix-cert", bundle.chain[0].Raw}, nil
+	case "issuer-der":
+		if len(bundle.chain) < 2 {
+			return nil, fmt.Errorf("issuer certificate not available")
+		}
+		return &ExportFile{domain + ".issuer.der", "application/pkix-cert", bundle.chain[1].Raw}, nil
+	case "p12":
+		if password == "" {
+			return nil, fmt.Errorf("a password is required for PKCS#12 export")
+		}
+		pfx, err := bundle.pkcs12(password, legacy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode PKCS#12: %w", err)
+		}
+		return &ExportFile{domain + ".p12", "application/x-pkcs12", pfx}, nil
+	case "zip":
+		data, err := bundle.zipBundle(password, legacy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build ZIP bundle: %w", err)
+		}
+		return &ExportFile{domain + ".zip", "application/zip", data}, nil
+	default:
+		return nil, fmt.Errorf("unknown export type: %s", fileType)
+	}
+}
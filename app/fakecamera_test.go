@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCamera is an Axis device for tests. It serves API discovery, the SOAP
+// certificate and web server services, the REST configuration APIs, and HTTPS
+// with the certificate its web server is bound to.
+type fakeCamera struct {
+	server *httptest.Server
+	// apis are listed by API discovery.
+	apis []string
+
+	mu    sync.Mutex
+	certs map[string]fakeCert
+	cas   map[string]fakeCert
+	tls   webServerTlsConfiguration
+	// calls records each request as "SOAP <operation>" or "<method> <path>".
+	calls []string
+	// fail makes the calls listed fail with the status code.
+	fail map[string]int
+	// params are the parameters served by param.cgi, unknown ones are missing.
+	params map[string]string
+}
+
+// fakeCert is a stored certificate, its key PKCS#8 DER or nil.
+type fakeCert struct {
+	der []byte
+	key []byte
+}
+
+func newFakeCamera(t *testing.T, apis ...string) *fakeCamera {
+	t.Helper()
+	fc := &fakeCamera{
+		apis:   apis,
+		certs:  make(map[string]fakeCert),
+		cas:    make(map[string]fakeCert),
+		fail:   make(map[string]int),
+		params: make(map[string]string),
+	}
+	cert, key := newTestCert(t, &x509.Certificate{DNSNames: []string{"axis-camera.local"}}, nil, nil)
+	fc.addCert("default", cert, key)
+	fc.tls = webServerTlsConfiguration{Tls: true, CertificateSet: certificateSet{Certificates: []string{"default"}}}
+
+	fc.server = httptest.NewUnstartedServer(fc)
+	fc.server.TLS = &tls.Config{GetCertificate: fc.servedCertificate}
+	fc.server.StartTLS()
+	t.Cleanup(fc.server.Close)
+	return fc
+}
+
+// device returns a Device for the camera using backend.
+func (fc *fakeCamera) device(backend string) *Device {
+	dev := newRemoteDevice(strings.TrimPrefix(fc.server.URL, "https://"), "root", "pass", true)
+	dev.Backend = backend
+	return dev
+}
+
+func (fc *fakeCamera) addCert(id string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	fc.certs[id] = fakeCert{der: cert.Raw, key: der}
+}
+
+func (fc *fakeCamera) addCA(id string, cert *x509.Certificate) {
+	fc.cas[id] = fakeCert{der: cert.Raw}
+}
+
+// called reports whether call was received, e.g. "SOAP GetCertificates".
+func (fc *fakeCamera) called(call string) bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return slices.Contains(fc.calls, call)
+}
+
+// calledPrefix reports whether any call starting with prefix was received.
+func (fc *fakeCamera) calledPrefix(prefix string) bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return slices.ContainsFunc(fc.calls, func(c string) bool { return strings.HasPrefix(c, prefix) })
+}
+
+func (fc *fakeCamera) count(call string) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	n := 0
+	for _, c := range fc.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+// servedCertificate presents the certificate the web server is bound to.
+func (fc *fakeCamera) servedCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.tls.CertificateSet.Certificates) == 0 {
+		return nil, fmt.Errorf("no certificate bound")
+	}
+	c, ok := fc.certs[fc.tls.CertificateSet.Certificates[0]]
+	if !ok || c.key == nil {
+		return nil, fmt.Errorf("bound certificate not found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: key}, nil
+}
+
+func (fc *fakeCamera) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if r.URL.Path == vapixServicesPath {
+		fc.serveSOAP(w, body)
+		return
+	}
+	call := r.Method + " " + r.URL.Path
+	fc.calls = append(fc.calls, call)
+	if code := fc.fail[call]; code != 0 {
+		writeRESTError(w, code, "injected failure")
+		return
+	}
+	switch {
+	case r.URL.Path == apiDiscoveryPath:
+		var list []map[string]string
+		for _, id := range fc.apis {
+			list = append(list, map[string]string{"id": id, "version": "1.0"})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"apiList": list}})
+	case strings.HasPrefix(r.URL.Path, "/config/rest/"):
+		fc.serveREST(w, r, body)
+	case r.URL.Path == "/axis-cgi/param.cgi":
+		group := r.URL.Query().Get("group")
+		if value, ok := fc.params[group]; ok {
+			fmt.Fprintf(w, "root.%s=%s\n", group, value)
+			return
+		}
+		fmt.Fprintf(w, "# Error: Error -1 getting param in group '%s'\n", group)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// soapOperation returns the local name of the first element in a SOAP body.
+func soapOperation(content []byte) string {
+	dec := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local
+		}
+	}
+}
+
+func (fc *fakeCamera) serveSOAP(w http.ResponseWriter, body []byte) {
+	var envelope struct {
+		Body struct {
+			Content []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	content := envelope.Body.Content
+	op := soapOperation(content)
+	fc.calls = append(fc.calls, "SOAP "+op)
+	if code := fc.fail["SOAP "+op]; code != 0 {
+		writeSOAPFault(w, "ter:InvalidArgVal", "injected failure")
+		return
+	}
+
+	var response any
+	switch op {
+	case "GetCertificates":
+		response = getCertificatesResponse{Certificates: fakeEntries(fc.certs)}
+	case "GetCACertificates":
+		response = getCACertificatesResponse{Certificates: fakeEntries(fc.cas)}
+	case "LoadCertificateWithPrivateKey":
+		var req struct {
+			ID   string `xml:"CertificateWithPrivateKey>CertificateID"`
+			Cert string `xml:"CertificateWithPrivateKey>Certificate>Data"`
+			Key  string `xml:"CertificateWithPrivateKey>PrivateKey>Data"`
+		}
+		xml.Unmarshal(content, &req)
+		der, _ := base64.StdEncoding.DecodeString(req.Cert)
+		key, _ := base64.StdEncoding.DecodeString(req.Key)
+		fc.certs[req.ID] = fakeCert{der: der, key: key}
+	case "LoadCACertificates":
+		var req struct {
+			Certificates []certificateEntry `xml:"CACertificate"`
+		}
+		xml.Unmarshal(content, &req)
+		for _, c := range req.Certificates {
+			der, _ := base64.StdEncoding.DecodeString(c.Data)
+			fc.cas[c.ID] = fakeCert{der: der}
+		}
+	case "DeleteCertificates":
+		var req struct {
+			IDs []string `xml:"CertificateID"`
+		}
+		xml.Unmarshal(content, &req)
+		for _, id := range req.IDs {
+			if _, ok := fc.certs[id]; ok {
+				delete(fc.certs, id)
+			} else if _, ok := fc.cas[id]; ok {
+				delete(fc.cas, id)
+			} else {
+				writeSOAPFault(w, "ter:InvalidArgVal", "unknown certificate "+id)
+				return
+			}
+		}
+	case "GetWebServerTlsConfiguration":
+		response = getWebServerTlsConfigurationResponse{Configuration: fc.tls}
+	case "SetWebServerTlsConfiguration":
+		var req getWebServerTlsConfigurationResponse
+		xml.Unmarshal(content, &req)
+		fc.tls = req.Configuration
+	default:
+		writeSOAPFault(w, "ter:ActionNotSupported", op+" is not supported")
+		return
+	}
+
+	var inner []byte
+	if response != nil {
+		inner, _ = xml.Marshal(response)
+	}
+	w.Header().Set("Content-Type", "application/soap+xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body>%s</env:Body></env:Envelope>`, inner)
+}
+
+func writeSOAPFault(w http.ResponseWriter, subcode, reason string) {
+	w.Header().Set("Content-Type", "application/soap+xml")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><env:Fault>`+
+		`<env:Code><env:Value>env:Sender</env:Value><env:Subcode><env:Value>%s</env:Value></env:Subcode></env:Code>`+
+		`<env:Reason><env:Text xml:lang="en">%s</env:Text></env:Reason></env:Fault></env:Body></env:Envelope>`, subcode, reason)
+}
+
+// fakeEntries lists a store as GetCertificates entries, sorted by ID.
+func fakeEntries(store map[string]fakeCert) []certificateEntry {
+	var entries []certificateEntry
+	for id, c := range store {
+		entries = append(entries, certificateEntry{ID: id, Data: base64.StdEncoding.EncodeToString(c.der)})
+	}
+	slices.SortFunc(entries, func(a, b certificateEntry) int { return strings.Compare(a.ID, b.ID) })
+	return entries
+}
+
+func (fc *fakeCamera) serveREST(w http.ResponseWriter, r *http.Request, body []byte) {
+	var request struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil || request.Data == nil {
+			writeRESTError(w, http.StatusBadRequest, "request must be wrapped in data")
+			return
+		}
+	}
+	stores := map[string]map[string]fakeCert{restCertificatesPath: fc.certs, restCACertificatesPath: fc.cas}
+
+	switch p := r.URL.Path; {
+	case p == restWebServerTLSPath && r.Method == "GET":
+		writeREST(w, fc.tls)
+	case p == restWebServerTLSPath && r.Method == "PUT":
+		var config webServerTlsConfiguration
+		json.Unmarshal(request.Data, &config)
+		fc.tls = config
+		writeREST(w, nil)
+	case stores[p] != nil && r.Method == "GET":
+		var certs []restCertificate
+		for _, e := range fakeEntries(stores[p]) {
+			der, _ := base64.StdEncoding.DecodeString(e.Data)
+			certs = append(certs, restCertificate{ID: e.ID, Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))})
+		}
+		writeREST(w, certs)
+	case stores[p] != nil && r.Method == "POST":
+		var c restCertificate
+		json.Unmarshal(request.Data, &c)
+		if _, ok := stores[p][c.ID]; ok {
+			writeRESTError(w, http.StatusConflict, "certificate exists")
+			return
+		}
+		certBlock, _ := pem.Decode([]byte(c.Certificate))
+		stored := fakeCert{der: certBlock.Bytes}
+		if keyBlock, _ := pem.Decode([]byte(c.PrivateKey)); keyBlock != nil {
+			stored.key = keyBlock.Bytes
+		}
+		stores[p][c.ID] = stored
+		writeREST(w, nil)
+	case stores[path.Dir(p)] != nil && r.Method == "DELETE":
+		store, id := stores[path.Dir(p)], path.Base(p)
+		if _, ok := store[id]; !ok {
+			writeRESTError(w, http.StatusNotFound, "certificate not found")
+			return
+		}
+		delete(store, id)
+		writeREST(w, nil)
+	default:
+		writeRESTError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeREST(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func writeRESTError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": code, "message": message}})
+}
+
+// newTestCert creates a certificate from template, signed by parent or
+// self-signed if parent is nil.
+func newTestCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber, _ = rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	if template.Subject.CommonName == "" && len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testChain is a leaf certificate issued by an intermediate of a root.
+type testChain struct {
+	root, intermediate, leaf *x509.Certificate
+	leafKey                  *ecdsa.PrivateKey
+}
+
+func newTestChain(t *testing.T, dnsNames ...string) *testChain {
+	t.Helper()
+	ca := func(name string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+	root, rootKey := newTestCert(t, ca("Test Root"), nil, nil)
+	intermediate, intermediateKey := newTestCert(t, ca("Test Intermediate"), root, rootKey)
+	leaf, leafKey := newTestCert(t, &x509.Certificate{DNSNames: dnsNames}, intermediate, intermediateKey)
+	return &testChain{root: root, intermediate: intermediate, leaf: leaf, leafKey: leafKey}
+}
+
+// writeLegoCert stores chain as lego's certificate of domain, in a temporary
+// working directory.
+func writeLegoCert(t *testing.T, domain string, chain *testChain) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(path.Dir(legoCertPath(domain, ".crt")), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	encode := func(certs ...*x509.Certificate) []byte {
+		var out []byte
+		for _, c := range certs {
+			out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+		return out
+	}
+	keyDER, err := x509.MarshalECPrivateKey(chain.leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		".crt":        encode(chain.leaf, chain.intermediate),
+		".issuer.crt": encode(chain.intermediate, chain.root),
+		".key":        pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for ext, data := range files {
+		if err := os.WriteFile(legoCertPath(domain, ext), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
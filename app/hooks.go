@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Deploy hook types.
+const (
+	// HookHTTP uploads the certificate to an HTTP(S) endpoint.
+	HookHTTP = "http"
+	// HookScript runs an uploaded script.
+	HookScript = "script"
+	// HookLego has lego run an uploaded script as --run-hook/--renew-hook.
+	HookLego = "lego"
+)
+
+// Events a deploy hook runs on. Lego hooks always run on issue.
+const (
+	HookOnIssue   = "issue"
+	HookOnInstall = "install"
+)
+
+// Authentication of HTTP hooks.
+const (
+	HookAuthNone   = "none"
+	HookAuthBasic  = "basic"
+	HookAuthBearer = "bearer"
+	HookAuthHeader = "header"
+)
+
+const (
+	legoHooksPath             = "./localdata/hooks"
+	legoHookDispatcherPath    = legoHooksPath + "/lego-hook.sh"
+	legoHookResultsPath       = legoHooksPath + "/lego-hook.results"
+	defaultHookTimeoutSeconds = 60
+	maxHookTimeoutSeconds     = 600
+	// hookOutputLimit caps the output stored per hook run.
+	hookOutputLimit = 4096
+	// hookWaitDelay is how long a killed script may keep its output open.
+	hookWaitDelay = 5 * time.Second
+)
+
+// DeployHook delivers the certificate elsewhere after it was issued or
+// installed, e.g. to a file share or another server.
+type DeployHook struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Enabled   bool      `json:"enabled"`
+	// On is the event the hook runs on, issue or install. Empty means issue.
+	On string `json:"on"`
+	// HTTP hooks send the export Format (see GET /api/cert/download/:type) to
+	// URL. {domain} and {file} in URL are replaced.
+	URL    string `json:"url"`
+	Method string `json:"method"`
+	Format string `json:"format"`
+	// ExportPassword protects p12 exports. Write-only, like Secret.
+	ExportPassword string `json:"export_password,omitempty"`
+	AuthType       string `json:"auth_type"`
+	Username       string `json:"username"`
+	// Secret is the basic auth password, bearer token or header value.
+	Secret     string `json:"secret,omitempty"`
+	HeaderName string `json:"header_name"`
+	SkipVerify bool   `json:"skip_verify"`
+	// TimeoutSeconds limits an upload or script run. 0 means 60.
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// HasScript tells whether a script was uploaded for the hook.
+	HasScript bool `gorm:"-" json:"has_script"`
+	// Result of the last run
+	LastRunAt  *time.Time `json:"last_run_at"`
+	LastStatus string     `json:"last_status"`
+	LastError  string     `json:"last_error"`
+}
+
+// redacted returns a copy safe to send to clients.
+func (h DeployHook) redacted() DeployHook {
+	h.Secret = ""
+	h.ExportPassword = ""
+	h.HasScript = fileExists(h.scriptPath())
+	return h
+}
+
+// scriptPath is where the script of a script or lego hook is stored.
+func (h *DeployHook) scriptPath() string {
+	return fmt.Sprintf("%s/%d.sh", legoHooksPath, h.ID)
+}
+
+func (h *DeployHook) timeout() time.Duration {
+	if h.TimeoutSeconds <= 0 {
+		return defaultHookTimeoutSeconds * time.Second
+	}
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+// validateDeployHook checks a hook before it is saved and fills in defaults.
+func validateDeployHook(h *DeployHook) error {
+	switch h.Type {
+	case HookHTTP, HookScript:
+	case HookLego:
+		h.On = HookOnIssue
+	default:
+		return fmt.Errorf("type must be %s, %s or %s", HookHTTP, HookScript, HookLego)
+	}
+	switch h.On {
+	case "":
+		h.On = HookOnIssue
+	case HookOnIssue, HookOnInstall:
+	default:
+		return fmt.Errorf("on must be %s or %s", HookOnIssue, HookOnInstall)
+	}
+	if h.TimeoutSeconds < 0 || h.TimeoutSeconds > maxHookTimeoutSeconds {
+		return fmt.Errorf("timeout_seconds must be between 0 and %d", maxHookTimeoutSeconds)
+	}
+	if h.Type != HookHTTP {
+		return nil
+	}
+
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	h.Method = strings.ToUpper(h.Method)
+	switch h.Method {
+	case "":
+		h.Method = http.MethodPut
+	case http.MethodPut, http.MethodPost:
+	default:
+		return fmt.Errorf("method must be PUT or POST")
+	}
+	if h.Format == "" {
+		h.Format = "fullchain"
+	}
+	if !slices.Contains(exportTypes, h.Format) {
+		return fmt.Errorf("format must be one of %s", strings.Join(exportTypes, ", "))
+	}
+	switch h.AuthType {
+	case "":
+		h.AuthType = HookAuthNone
+	case HookAuthNone, HookAuthBasic, HookAuthBearer:
+	case HookAuthHeader:
+		if h.HeaderName == "" {
+			return fmt.Errorf("header_name is required for header auth")
+		}
+	default:
+		return fmt.Errorf("auth_type must be none, basic, bearer or header")
+	}
+	return nil
+}
+
+func GetDeployHooks(db *gorm.DB) ([]DeployHook, error) {
+	var hooks []DeployHook
+	if err := db.Order("id").Find(&hooks).Error; err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func GetDeployHook(db *gorm.DB, id uint) (*DeployHook, error) {
+	var hook DeployHook
+	if err := db.First(&hook, id).Error; err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// saveHookScript stores the script of a hook, executable.
+func saveHookScript(h *DeployHook, script []byte) error {
+	if len(bytes.TrimSpace(script)) == 0 {
+		return fmt.Errorf("script is empty")
+	}
+	if err := os.MkdirAll(legoHooksPath, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(h.scriptPath(), script, 0755)
+}
+
+// hookEnv describes the certificate to scripts. LEGO_CERT_DOMAIN, LEGO_CERT_PATH
+// and LEGO_CERT_KEY_PATH match what lego sets for its hooks, so a script works
+// as both script and lego hook.
+func hookEnv(event, domain string) []string {
+	abs := func(path string) string {
+		if p, err := filepath.Abs(path); err == nil {
+			return p
+		}
+		return path
+	}
+	return []string{
+		"LEGO_ACAP_EVENT=" + event,
+		"LEGO_CERT_DOMAIN=" + domain,
+		"LEGO_CERT_PATH=" + abs(legoCertPath(domain, ".crt")),
+		"LEGO_CERT_KEY_PATH=" + abs(legoCertPath(domain, ".key")),
+		"LEGO_CERT_ISSUER_PATH=" + abs(legoCertPath(domain, ".issuer.crt")),
+	}
+}
+
+// truncateOutput keeps the first hookOutputLimit bytes of output.
+func truncateOutput(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > hookOutputLimit {
+		return output[:hookOutputLimit] + "..."
+	}
+	return output
+}
+
+// runHTTPHook uploads the certificate of domain as configured in h.
+func runHTTPHook(h *DeployHook, domain string) (string, error) {
+	export, err := buildExport(domain, h.Format, h.ExportPassword, false)
+	if err != nil {
+		return "", err
+	}
+	target := strings.NewReplacer("{domain}", url.PathEscape(domain), "{file}", url.PathEscape(export.Name)).Replace(h.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, h.Method, target, bytes.NewReader(export.Data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", export.ContentType)
+	switch h.AuthType {
+	case HookAuthBasic:
+		req.SetBasicAuth(h.Username, h.Secret)
+	case HookAuthBearer:
+		req.Header.Set("Authorization", "Bearer "+h.Secret)
+	case HookAuthHeader:
+		req.Header.Set(h.HeaderName, h.Secret)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: h.SkipVerify}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, hookOutputLimit))
+	if resp.StatusCode/100 != 2 {
+		return string(body), fmt.Errorf("upload returned status %d", resp.StatusCode)
+	}
+	return fmt.Sprintf("Uploaded %s with %s, status %d", export.Name, h.Method, resp.StatusCode), nil
+}
+
+// runScriptHook runs the script of h and returns its output and exit code.
+func runScriptHook(h *DeployHook, event, domain string) (string, int, error) {
+	if !fileExists(h.scriptPath()) {
+		return "", -1, fmt.Errorf("no script uploaded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.scriptPath())
+	cmd.Env = append(os.Environ(), hookEnv(event, domain)...)
+	// The script runs in its own process group, so a timeout also kills the
+	// processes it started instead of waiting for them to close its output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.CombinedOutput()
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() != nil {
+		return string(output), exitCode, fmt.Errorf("script timed out after %s", h.timeout())
+	}
+	if err != nil {
+		return string(output), exitCode, fmt.Errorf("script failed: %w", err)
+	}
+	return string(output), exitCode, nil
+}
+
+// runDeployHook runs one HTTP or script hook and records the outcome.
+func (app *LegoApplication) runDeployHook(h *DeployHook, event, domain, trigger string, parent *RunHistory) error {
+	started := time.Now()
+	var output string
+	var exitCode int
+	var err error
+	switch h.Type {
+	case HookHTTP:
+		output, err = runHTTPHook(h, domain)
+	case HookScript:
+		output, exitCode, err = runScriptHook(h, event, domain)
+	default:
+		return fmt.Errorf("%s hooks run as part of lego run and renew", h.Type)
+	}
+	app.recordHookRun(h, domain, trigger, parent, started, time.Now(), exitCode, output, err)
+	return err
+}
+
+// runDeployHooks runs the enabled HTTP and script hooks for event, one after another.
+func (app *LegoApplication) runDeployHooks(event, domain string, parent *RunHistory) {
+	app.hookMu.Lock()
+	defer app.hookMu.Unlock()
+
+	hooks, err := GetDeployHooks(app.db)
+	if err != nil {
+		app.acapp.Syslog.Errorf("Failed to load deploy hooks: %s", err)
+		return
+	}
+	for i := range hooks {
+		h := &hooks[i]
+		if !h.Enabled || h.Type == HookLego || h.On != event {
+			continue
+		}
+		app.runDeployHook(h, event, domain, parent.Trigger, parent)
+	}
+}
+
+// recordHookRun stores a hook run in the run history, linked to parent, and
+// the outcome on the hook.
+func (app *LegoApplication) recordHookRun(h *DeployHook, domain, trigger string, parent *RunHistory, started, finished time.Time, exitCode int, output string, err error) {
+	output = truncateOutput(output)
+	lines := []string{fmt.Sprintf("Deploy hook %s (%s)", h.Name, h.Type)}
+	if output != "" {
+		lines = append(lines, output)
+	}
+	if err != nil {
+		lines = append(lines, err.Error())
+	}
+	hookID := h.ID
+	run := &RunHistory{
+		Command:    historyCommand("deploy", trigger),
+		Trigger:    trigger,
+		Success:    err == nil,
+		ExitCode:   exitCode,
+		Output:     strings.Join(lines, "\n"),
+		StartedAt:  started,
+		FinishedAt: finished,
+		HookID:     &hookID,
+	}
+	if parent != nil && parent.ID != 0 {
+		parentID := parent.ID
+		run.ParentRunID = &parentID
+	}
+	recordCertState(run, domain)
+	if serr := SaveRunHistory(app.db, run); serr != nil {
+		app.acapp.Syslog.Errorf("Failed to save run history: %s", serr)
+	}
+
+	h.LastRunAt = &run.FinishedAt
+	if err != nil {
+		h.LastStatus, h.LastError = PushFailed, err.Error()
+		app.acapp.Syslog.Errorf("Deploy hook %s failed: %s", h.Name, err)
+	} else {
+		h.LastStatus, h.LastError = PushSuccess, ""
+		app.acapp.Syslog.Infof("Deploy hook %s succeeded", h.Name)
+	}
+	if serr := app.db.Model(h).Select("LastRunAt", "LastStatus", "LastError").Updates(h).Error; serr != nil {
+		app.acapp.Syslog.Errorf("Failed to save hook status: %s", serr)
+	}
+	app.wsHub.Broadcast(MsgHookResult, h.redacted())
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// prepareLegoHooks writes the dispatcher lego runs as its hook. It runs each
+// enabled lego hook and writes their results for recordLegoHooks, always
+// exiting 0 so a failing hook doesn't fail the lego run. Returns the hooks and
+// the dispatcher path, or no hooks and "" if none is enabled.
+func (app *LegoApplication) prepareLegoHooks() ([]DeployHook, string) {
+	hooks, err := GetDeployHooks(app.db)
+	if err != nil {
+		app.acapp.Syslog.Errorf("Failed to load deploy hooks: %s", err)
+		return nil, ""
+	}
+	var enabled []DeployHook
+	for _, h := range hooks {
+		if h.Enabled && h.Type == HookLego && fileExists(h.scriptPath()) {
+			enabled = append(enabled, h)
+		}
+	}
+	os.Remove(legoHookResultsPath)
+	if len(enabled) == 0 {
+		return nil, ""
+	}
+
+	dispatcher, err := writeLegoHookDispatcher(enabled)
+	if err != nil {
+		app.acapp.Syslog.Errorf("Failed to write lego hook: %s", err)
+		return nil, ""
+	}
+	return enabled, dispatcher
+}
+
+// writeLegoHookDispatcher writes the dispatcher script running hooks and
+// returns its absolute path.
+func writeLegoHookDispatcher(hooks []DeployHook) (string, error) {
+	dispatcher, err := filepath.Abs(legoHookDispatcherPath)
+	if err != nil {
+		return "", err
+	}
+	results, _ := filepath.Abs(legoHookResultsPath)
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n# Generated by lego-acap, runs the lego deploy hooks.\n")
+	fmt.Fprintf(&script, "results=%s\n: > \"$results\"\n", shellQuote(results))
+	script.WriteString("run_hook() {\n\tstart=$(date +%s)\n\toutput=$(\"$2\" 2>&1)\n\tcode=$?\n" +
+		"\tprintf '%s\\n' \"$output\"\n" +
+		"\tprintf '%s\\t%s\\t%s\\t%s\\t%s\\n' \"$1\" \"$code\" \"$start\" \"$(date +%s)\" " +
+		"\"$(printf '%s' \"$output\" | tr '\\t\\n' '  ')\" >> \"$results\"\n}\n")
+	for _, h := range hooks {
+		path, _ := filepath.Abs(h.scriptPath())
+		fmt.Fprintf(&script, "run_hook %d %s\n", h.ID, shellQuote(path))
+	}
+	script.WriteString("exit 0\n")
+	if err := os.WriteFile(dispatcher, []byte(script.String()), 0755); err != nil {
+		return "", err
+	}
+	return dispatcher, nil
+}
+
+// legoHookResult is a line the dispatcher wrote for a lego hook: the hook ID,
+// exit code, start and end as Unix seconds, and the output on one line.
+type legoHookResult struct {
+	hookID   uint64
+	exitCode int
+	started  time.Time
+	finished time.Time
+	output   string
+}
+
+// parseLegoHookResults reads the results the dispatcher wrote, skipping
+// malformed lines.
+func parseLegoHookResults(r io.Reader) []legoHookResult {
+	var results []legoHookResult
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 5)
+		if len(fields) < 4 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		exitCode, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		started, serr := strconv.ParseInt(fields[2], 10, 64)
+		finished, ferr := strconv.ParseInt(fields[3], 10, 64)
+		if serr != nil || ferr != nil {
+			continue
+		}
+		result := legoHookResult{hookID: id, exitCode: exitCode, started: time.Unix(started, 0), finished: time.Unix(finished, 0)}
+		if len(fields) == 5 {
+			result.output = fields[4]
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// recordLegoHooks records the results the dispatcher wrote for hooks during
+// the lego run parent. Hooks lego didn't run, e.g. after a failed run, are
+// not recorded.
+func (app *LegoApplication) recordLegoHooks(hooks []DeployHook, domain string, parent *RunHistory) {
+	f, err := os.Open(legoHookResultsPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	for _, result := range parseLegoHookResults(f) {
+		i := slices.IndexFunc(hooks, func(h DeployHook) bool { return uint64(h.ID) == result.hookID })
+		if i < 0 {
+			continue
+		}
+		var hookErr error
+		if result.exitCode != 0 {
+			hookErr = fmt.Errorf("hook exited with code %d", result.exitCode)
+		}
+		app.recordHookRun(&hooks[i], domain, parent.Trigger, parent, result.started, result.finished, result.exitCode, result.output, hookErr)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Connection policies of the camera web server per user group.
+const (
+	PolicyHttpOnly     = "HttpOnly"
+	PolicyHttpsOnly    = "HttpsOnly"
+	PolicyHttpAndHttps = "HttpAndHttps"
+)
+
+const (
+	// httpsRedirectParam is the camera parameter redirecting HTTP requests to HTTPS.
+	httpsRedirectParam = "HTTPS.RedirectToHTTPS"
+	// httpsAvailableCiphersParam lists the ciphers the camera supports, as
+	// opposed to HTTPS.Ciphers, the configured ones.
+	httpsAvailableCiphersParam = "HTTPS.AvailableCiphers"
+)
+
+// errCameraParamMissing is returned for parameters the camera doesn't have.
+var errCameraParamMissing = errors.New("parameter not found")
+
+// HTTPSPolicy is the HTTPS posture enforced on the camera. Empty fields keep
+// the camera's current setting.
+type HTTPSPolicy struct {
+	Admin    string   `json:"admin"`
+	Operator string   `json:"operator"`
+	Viewer   string   `json:"viewer"`
+	Ciphers  []string `json:"ciphers"`
+	Redirect *bool    `json:"redirect"`
+}
+
+// HTTPSPolicyFromConfig builds the HTTPS policy from the saved config.
+func HTTPSPolicyFromConfig(config *Config) *HTTPSPolicy {
+	return &HTTPSPolicy{
+		Admin:    config.HTTPSAdminPolicy,
+		Operator: config.HTTPSOperatorPolicy,
+		Viewer:   config.HTTPSViewerPolicy,
+		Ciphers:  splitCiphers(config.HTTPSCiphers),
+		Redirect: config.HTTPSRedirect,
+	}
+}
+
+// splitCiphers splits a colon or comma separated cipher list.
+func splitCiphers(ciphers string) []string {
+	var out []string
+	for _, c := range strings.FieldsFunc(ciphers, func(r rune) bool { return r == ':' || r == ',' }) {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// validateHTTPSPolicy checks the connection policies before a config is saved.
+// Ciphers are checked against the camera on install.
+func validateHTTPSPolicy(config *Config) error {
+	for _, p := range []struct{ group, value string }{
+		{"admin", config.HTTPSAdminPolicy},
+		{"operator", config.HTTPSOperatorPolicy},
+		{"viewer", config.HTTPSViewerPolicy},
+	} {
+		switch p.value {
+		case "", PolicyHttpOnly, PolicyHttpsOnly, PolicyHttpAndHttps:
+		default:
+			return fmt.Errorf("invalid %s connection policy %q", p.group, p.value)
+		}
+	}
+	return nil
+}
+
+// apply sets the policy on a TLS configuration read from the camera. Ciphers
+// must be supported by the camera.
+func (p *HTTPSPolicy) apply(tls *webServerTlsConfiguration, available []string) error {
+	if p.Admin != "" {
+		tls.ConnectionPolicies.Admin = p.Admin
+	}
+	if p.Operator != "" {
+		tls.ConnectionPolicies.Operator = p.Operator
+	}
+	if p.Viewer != "" {
+		tls.ConnectionPolicies.Viewer = p.Viewer
+	}
+	if len(p.Ciphers) > 0 {
+		for _, c := range p.Ciphers {
+			if !slices.Contains(available, c) {
+				return fmt.Errorf("cipher %s is not supported by the camera", c)
+			}
+		}
+		tls.Ciphers = p.Ciphers
+	}
+	return nil
+}
+
+// verify compares the configuration read back from the camera with the policy.
+func (p *HTTPSPolicy) verify(tls *webServerTlsConfiguration) error {
+	for _, c := range []struct{ group, want, got string }{
+		{"admin", p.Admin, tls.ConnectionPolicies.Admin},
+		{"operator", p.Operator, tls.ConnectionPolicies.Operator},
+		{"viewer", p.Viewer, tls.ConnectionPolicies.Viewer},
+	} {
+		if c.want != "" && c.want != strings.TrimSpace(c.got) {
+			return fmt.Errorf("%s connection policy is %q, expected %q", c.group, c.got, c.want)
+		}
+	}
+	if len(p.Ciphers) > 0 {
+		got := make([]string, 0, len(tls.Ciphers))
+		for _, c := range tls.Ciphers {
+			got = append(got, strings.TrimSpace(c))
+		}
+		if !slices.Equal(got, p.Ciphers) {
+			return fmt.Errorf("cipher list is %s, expected %s", strings.Join(got, ":"), strings.Join(p.Ciphers, ":"))
+		}
+	}
+	return nil
+}
+
+// applyRedirect sets and verifies the HTTP to HTTPS redirect, if configured.
+func (p *HTTPSPolicy) applyRedirect(dev *Device) error {
+	if p.Redirect == nil {
+		return nil
+	}
+	want := "no"
+	if *p.Redirect {
+		want = "yes"
+	}
+	// Read first, so a camera without the parameter fails with a clear error
+	current, err := getCameraParam(dev, httpsRedirectParam)
+	if errors.Is(err, errCameraParamMissing) {
+		return fmt.Errorf("camera does not support the HTTPS redirect: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read HTTPS redirect: %w", err)
+	}
+	if strings.EqualFold(current, want) {
+		return nil
+	}
+	if err := setCameraParam(dev, httpsRedirectParam, want); err != nil {
+		return fmt.Errorf("failed to set HTTPS redirect: %w", err)
+	}
+	got, err := getCameraParam(dev, httpsRedirectParam)
+	if err != nil {
+		return fmt.Errorf("failed to verify HTTPS redirect: %w", err)
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("HTTPS redirect is %q, expected %q", got, want)
+	}
+	return nil
+}
+
+// applyHTTPSPolicy enforces policy on the camera without changing the certificate.
+func applyHTTPSPolicy(dev *Device, policy *HTTPSPolicy) error {
+	tlsConfig, err := getWebServerTlsConfiguration(dev)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTPS configuration: %w", err)
+	}
+	var available []string
+	if len(policy.Ciphers) > 0 {
+		if available, err = fetchSupportedCiphers(dev); err != nil {
+			return err
+		}
+	}
+	if err := policy.apply(tlsConfig, available); err != nil {
+		return err
+	}
+	if err := setWebServerTlsConfiguration(dev, tlsConfig); err != nil {
+		return fmt.Errorf("failed to set HTTPS configuration: %w", err)
+	}
+	return verifyHTTPSConfiguration(dev, policy, tlsConfig.CertificateSet.Certificates)
+}
+
+// verifyHTTPSConfiguration reads the TLS configuration back and checks that the
+// certificate and policy were applied, then applies the redirect.
+func verifyHTTPSConfiguration(dev *Device, policy *HTTPSPolicy, certIDs []string) error {
+	applied, err := getWebServerTlsConfiguration(dev)
+	if err != nil {
+		return fmt.Errorf("failed to verify HTTPS configuration: %w", err)
+	}
+	var got []string
+	for _, id := range applied.CertificateSet.Certificates {
+		got = append(got, strings.TrimSpace(id))
+	}
+	if !slices.Equal(got, certIDs) {
+		return fmt.Errorf("camera uses certificate %s, expected %s", strings.Join(got, ","), strings.Join(certIDs, ","))
+	}
+	if err := policy.verify(applied); err != nil {
+		return fmt.Errorf("HTTPS policy not applied: %w", err)
+	}
+	return policy.applyRedirect(dev)
+}
+
+// cameraParamRequest sends a param.cgi request and returns the trimmed response.
+func cameraParamRequest(dev *Device, query string) (string, error) {
+	resp, err := dev.do("GET", "/axis-cgi/param.cgi?"+query, "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request returned status %d", resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// getCameraParam reads a single parameter, e.g. HTTPS.Ciphers. Parameters the
+// camera doesn't have return errCameraParamMissing.
+func getCameraParam(dev *Device, name string) (string, error) {
+	line, err := cameraParamRequest(dev, "action=list&group="+url.QueryEscape(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	// Response format: root.<name>=<value>, or "# Error: ..." for unknown parameters
+	if strings.HasPrefix(line, "# Error") {
+		return "", fmt.Errorf("%w: %s", errCameraParamMissing, name)
+	}
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return "", fmt.Errorf("unexpected parameter response: %s", line)
+	}
+	if !strings.EqualFold(strings.TrimPrefix(key, "root."), name) {
+		return "", fmt.Errorf("%w: %s (camera returned %s)", errCameraParamMissing, name, key)
+	}
+	return value, nil
+}
+
+func setCameraParam(dev *Device, name, value string) error {
+	resp, err := cameraParamRequest(dev, "action=update&"+url.QueryEscape(name)+"="+url.QueryEscape(value))
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", name, err)
+	}
+	if resp != "OK" {
+		return fmt.Errorf("failed to update %s: %s", name, resp)
+	}
+	return nil
+}
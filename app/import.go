@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// CertImportRequest is the body of POST /api/cert/import. Either the PEM fields
+// or PKCS12 (base64) with its password must be set.
+type CertImportRequest struct {
+	Certificate string `json:"certificate"`
+	Chain       string `json:"chain"`
+	PrivateKey  string `json:"private_key"`
+	PKCS12      string `json:"pkcs12"`
+	Password    string `json:"password"`
+}
+
+// importedCert is a parsed certificate import.
+type importedCert struct {
+	leaf     *x509.Certificate
+	chain    []*x509.Certificate
+	pkcs8Key []byte
+}
+
+// parseCertImport decodes the certificate, chain and key of an import request.
+func parseCertImport(req *CertImportRequest) (*importedCert, error) {
+	if req.PKCS12 != "" {
+		data, err := base64.StdEncoding.DecodeString(req.PKCS12)
+		if err != nil {
+			return nil, fmt.Errorf("pkcs12 is not valid base64: %w", err)
+		}
+		key, leaf, chain, err := pkcs12.DecodeChain(data, req.Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode PKCS#12: %w", err)
+		}
+		pkcs8Key, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported private key: %w", err)
+		}
+		return &importedCert{leaf: leaf, chain: chain, pkcs8Key: pkcs8Key}, nil
+	}
+
+	if req.Certificate == "" || req.PrivateKey == "" {
+		return nil, fmt.Errorf("certificate and private_key are required")
+	}
+	certs, err := parsePEMCertificates([]byte(req.Certificate + "\n" + req.Chain))
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode([]byte(req.PrivateKey))
+	if keyBlock == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM")
+	}
+	pkcs8Key, err := toPKCS8(keyBlock)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %w", err)
+	}
+
+	// Drop duplicates in case the chain repeats certificates from the bundle
+	imported := &importedCert{leaf: certs[0], pkcs8Key: pkcs8Key}
+	for _, cert := range certs[1:] {
+		duplicate := bytes.Equal(cert.Raw, imported.leaf.Raw)
+		for _, c := range imported.chain {
+			duplicate = duplicate || bytes.Equal(cert.Raw, c.Raw)
+		}
+		if !duplicate {
+			imported.chain = append(imported.chain, cert)
+		}
+	}
+	return imported, nil
+}
+
+// storeImportedCert writes an import into the lego certs layout for domain:
+// <domain>.crt holds leaf and chain, <domain>.issuer.crt the chain. Without a
+// chain, <domain>.issuer.crt is removed.
+func storeImportedCert(domain string, imported *importedCert) error {
+	if err := os.MkdirAll(filepath.Dir(legoCertPath(domain, ".crt")), 0700); err != nil {
+		return err
+	}
+
+	var chainPEM bytes.Buffer
+	for _, cert := range imported.chain {
+		pem.Encode(&chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: imported.leaf.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: imported.pkcs8Key})
+
+	// Write all files next to their targets first, then rename them into place
+	// with the certificate last, so a failure can't leave a key and a
+	// certificate that don't match.
+	files := []struct {
+		ext  string
+		data []byte
+	}{
+		{".key", keyPEM},
+		{".issuer.crt", chainPEM.Bytes()},
+		{".crt", append(leafPEM, chainPEM.Bytes()...)},
+	}
+	for _, f := range files {
+		if len(f.data) == 0 {
+			continue
+		}
+		tmp := legoCertPath(domain, f.ext) + ".tmp"
+		defer os.Remove(tmp)
+		if err := os.WriteFile(tmp, f.data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s%s: %w", domain, f.ext, err)
+		}
+	}
+	for _, f := range files {
+		target := legoCertPath(domain, f.ext)
+		if len(f.data) == 0 {
+			os.Remove(target)
+			continue
+		}
+		if err := os.Rename(target+".tmp", target); err != nil {
+			return fmt.Errorf("failed to store %s%s: %w", domain, f.ext, err)
+		}
+	}
+	return nil
+}
+
+// isImportedCert reports whether the certificate with serial was imported
+// rather than issued by lego.
+func isImportedCert(db *gorm.DB, serial string) bool {
+	var count int64
+	db.Model(&RunHistory{}).Where("command = ? AND success = ? AND cert_serial = ?", "import", true, serial).Count(&count)
+	return count > 0
+}
+
+// currentCertImported reports whether the certificate on disk for domain was
+// imported. Lego can't renew it.
+func currentCertImported(db *gorm.DB, domain string) bool {
+	cert, err := loadCertificate(legoCertPath(domain, ".crt"))
+	return err == nil && isImportedCert(db, cert.SerialNumber.String())
+}
+
+// importCertificate validates an import, stores it for the primary domain and
+// records it in the run history so expiry checks and CT monitoring know it.
+func (app *LegoApplication) importCertificate(config *Config, req *CertImportRequest, trigger string) (*RunHistory, error) {
+	domain := primaryDomain(config)
+	if domain == "" {
+		return nil, fmt.Errorf("configure the domains before importing a certificate")
+	}
+	imported, err := parseCertImport(req)
+	if err != nil {
+		return nil, &CertValidationError{ValidationInvalidCert, err.Error()}
+	}
+	if err := validateCertForInstall(imported.leaf, imported.pkcs8Key, domain); err != nil {
+		return nil, err
+	}
+
+	run := &RunHistory{Command: "import", Trigger: trigger, StartedAt: time.Now()}
+	err = storeImportedCert(domain, imported)
+	run.FinishedAt = time.Now()
+	run.Success = err == nil
+	if err != nil {
+		run.Output = err.Error()
+	} else {
+		run.Output = fmt.Sprintf("Imported certificate issued by %s", imported.leaf.Issuer.String())
+	}
+	recordCertState(run, domain)
+	if serr := SaveRunHistory(app.db, run); serr != nil {
+		app.acapp.Syslog.Errorf("Failed to save run history: %s", serr)
+	}
+	app.afterIssued(domain, run)
+	return run, err
+}
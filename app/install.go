@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Steps of a certificate install, reported as install_step WebSocket messages.
+const (
+	InstallStepValidate = "validate"
+	InstallStepRecord   = "record"
+	InstallStepUpload   = "upload"
+	InstallStepBind     = "bind"
+	InstallStepVerify   = "verify"
+	InstallStepRollback = "rollback"
+	InstallStepCleanup  = "cleanup"
+)
+
+// Status of an install step.
+const (
+	StepRunning = "running"
+	StepDone    = "done"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+// InstallStep is the progress of one install step.
+type InstallStep struct {
+	// Device is the remote device name, empty for this camera.
+	Device  string `json:"device,omitempty"`
+	Domain  string `json:"domain"`
+	Step    string `json:"step"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// String formats the step as a line for the run history.
+func (s InstallStep) String() string {
+	line := fmt.Sprintf("[%s] %s", s.Step, s.Status)
+	if s.Message != "" {
+		line += ": " + s.Message
+	}
+	return line
+}
+
+// installReporter reports a step of an install of domain to report, which may be nil.
+func installReporter(domain string, report func(InstallStep)) func(step, status, message string) {
+	return func(step, status, message string) {
+		if report != nil {
+			report(InstallStep{Domain: domain, Step: step, Status: status, Message: message})
+		}
+	}
+}
+
+const (
+	servedCertAttempts   = 5
+	servedCertRetryDelay = 2 * time.Second
+)
+
+// verifyServedCertificate checks with a TLS handshake that dev's HTTPS server
+// presents cert. The web server takes a moment to reload, so it is retried.
+func verifyServedCertificate(dev *Device, hostname string, cert *x509.Certificate) error {
+	var err error
+	for attempt := 0; attempt < servedCertAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(servedCertRetryDelay)
+		}
+		var served *x509.Certificate
+		served, err = fetchServedCertificate(dev.TLSAddr, hostname)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(served.Raw, cert.Raw) {
+			return nil
+		}
+		err = fmt.Errorf("%s presents certificate %s, expected %s", dev.TLSAddr, served.SerialNumber, cert.SerialNumber)
+	}
+	return err
+}
+
+// snapshotTargets records the current binding of each target.
+func snapshotTargets(dev *Device, targets []string) ([]*targetSnapshot, error) {
+	var snapshots []*targetSnapshot
+	for _, name := range targets {
+		snapshot, err := installTargets[name].snapshot(dev)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s configuration: %w", name, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// describeSnapshots lists the certificate each target used, for the record step.
+func describeSnapshots(snapshots []*targetSnapshot) string {
+	var parts []string
+	for _, s := range snapshots {
+		id := s.certID
+		if id == "" {
+			id = "none"
+		}
+		parts = append(parts, s.target+": "+id)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rollbackInstall restores the targets in snapshots, newest first, and deletes
+// the uploaded certificate certID. certID is new, so only the restored targets
+// can have used it. cause is the failure that triggered the rollback.
+func rollbackInstall(dev *Device, snapshots []*targetSnapshot, certID string, step func(step, status, message string), cause error) error {
+	step(InstallStepRollback, StepRunning, "")
+	var problems []string
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if err := snapshots[i].restore(); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to restore %s: %s", snapshots[i].target, err))
+		}
+	}
+	if len(problems) > 0 {
+		problems = append(problems, "kept "+certID)
+	} else if err := deleteCert(dev, certID); err != nil {
+		problems = append(problems, fmt.Sprintf("failed to delete %s: %s", certID, err))
+	}
+	// Intermediates uploaded for certID (best-effort)
+	if bound, err := boundCertificateIDs(dev); err == nil {
+		cleanupOldLegoCACerts(dev, bound)
+	}
+
+	if len(problems) > 0 {
+		msg := strings.Join(problems, "; ")
+		step(InstallStepRollback, StepFailed, msg)
+		return fmt.Errorf("%w; rollback incomplete: %s", cause, msg)
+	}
+	step(InstallStepRollback, StepDone, fmt.Sprintf("Restored %s, deleted %s", describeSnapshots(snapshots), certID))
+	return fmt.Errorf("%w; rolled back to the previous certificate", cause)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	errCameraCertNotFound  = errors.New("certificate not found on camera")
+	errCameraCertProtected = errors.New("certificate is protected")
+)
+
+// CameraCert is a certificate stored on the camera.
+type CameraCert struct {
+	ID string `json:"id"`
+	// CA is set for certificates from the CA store, e.g. uploaded intermediates.
+	CA        bool      `json:"ca"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	KeyType   string    `json:"key_type"`
+	// UsedBy lists the install targets bound to the certificate.
+	UsedBy []string `json:"used_by"`
+	// Managed is set for certificates uploaded by this app (lego- IDs).
+	Managed bool `json:"managed"`
+	// Deletable is set for managed certificates no service uses.
+	Deletable  bool   `json:"deletable"`
+	ParseError string `json:"parse_error,omitempty"`
+}
+
+// CameraCertInventory lists the certificates on the camera. BindingErrors holds
+// the targets whose bindings couldn't be read; while any are listed, nothing
+// is deletable.
+type CameraCertInventory struct {
+	// Backend is the install backend used to read the stores.
+	Backend       string            `json:"backend"`
+	Certificates  []CameraCert      `json:"certificates"`
+	BindingErrors map[string]string `json:"binding_errors,omitempty"`
+}
+
+// certBindings maps certificate IDs to the targets that use them.
+func certBindings(dev *Device) (map[string][]string, map[string]string) {
+	bindings := make(map[string][]string)
+	var failed map[string]string
+	for _, name := range slices.Sorted(maps.Keys(installTargets)) {
+		ids, err := installTargets[name].boundCerts(dev)
+		if errors.Is(err, errTargetUnsupported) {
+			continue
+		}
+		if err != nil {
+			if failed == nil {
+				failed = make(map[string]string)
+			}
+			failed[name] = err.Error()
+			continue
+		}
+		for _, id := range ids {
+			id = strings.TrimSpace(id)
+			if id != "" && !slices.Contains(bindings[id], name) {
+				bindings[id] = append(bindings[id], name)
+			}
+		}
+	}
+	return bindings, failed
+}
+
+// describeCameraCert parses a certificate entry read from the camera.
+func describeCameraCert(entry certificateEntry, ca bool) CameraCert {
+	c := CameraCert{
+		ID:      strings.TrimSpace(entry.ID),
+		CA:      ca,
+		UsedBy:  []string{},
+		Managed: strings.HasPrefix(strings.TrimSpace(entry.ID), legoCertIDPrefix),
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry.Data))
+	if err != nil {
+		c.ParseError = err.Error()
+		return c
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		c.ParseError = err.Error()
+		return c
+	}
+	c.Subject = cert.Subject.String()
+	c.Issuer = cert.Issuer.String()
+	c.Serial = cert.SerialNumber.String()
+	c.NotBefore = cert.NotBefore
+	c.NotAfter = cert.NotAfter
+	c.KeyType = certKeyType(cert)
+	return c
+}
+
+// getCameraCertInventory reads the certificate and CA stores of dev and the
+// services using each certificate.
+func getCameraCertInventory(dev *Device) (*CameraCertInventory, error) {
+	certs, err := dev.certs().listCertificates(dev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+	caCerts, err := dev.certs().listCACertificates(dev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CA certificates: %w", err)
+	}
+	bindings, failed := certBindings(dev)
+
+	inventory := &CameraCertInventory{Backend: dev.certs().name, Certificates: []CameraCert{}, BindingErrors: failed}
+	add := func(entries []certificateEntry, ca bool) {
+		for _, entry := range entries {
+			c := describeCameraCert(entry, ca)
+			if c.ID == "" {
+				continue
+			}
+			if used, ok := bindings[c.ID]; ok {
+				c.UsedBy = used
+			}
+			c.Deletable = c.Managed && len(c.UsedBy) == 0 && len(failed) == 0
+			inventory.Certificates = append(inventory.Certificates, c)
+		}
+	}
+	add(certs, false)
+	add(caCerts, true)
+	return inventory, nil
+}
+
+// deleteCameraCert deletes a managed certificate no service uses.
+func deleteCameraCert(dev *Device, id string) error {
+	inventory, err := getCameraCertInventory(dev)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(inventory.Certificates, func(c CameraCert) bool { return c.ID == id })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", errCameraCertNotFound, id)
+	}
+	c := inventory.Certificates[i]
+	switch {
+	case !c.Managed:
+		return fmt.Errorf("%w: %s is not managed by lego", errCameraCertProtected, id)
+	case len(c.UsedBy) > 0:
+		return fmt.Errorf("%w: %s is in use by %s", errCameraCertProtected, id, strings.Join(c.UsedBy, ", "))
+	case len(inventory.BindingErrors) > 0:
+		return fmt.Errorf("%w: bindings of %s can't be read", errCameraCertProtected,
+			strings.Join(slices.Sorted(maps.Keys(inventory.BindingErrors)), ", "))
+	}
+	if err := deleteCert(dev, id); err != nil {
+		return fmt.Errorf("failed to delete certificate %s: %w", id, err)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -25,13 +26,22 @@ const (
 	legoBinaryDir  = "./localdata"
 	legoBinaryPath = "./localdata/lego"
 	legoCertsPath  = "./localdata/certs"
+	// legoDefaultKeyType is the key type lego uses without --key-type.
+	legoDefaultKeyType = "ec256"
 
 	// legoRenewAlways forces lego to always perform the renewal when invoked.
 	// The actual expiry threshold check is done in checkAndAutoRenew before calling RunLego.
 	// For manual renewals, users expect it to always renew.
 	legoRenewAlways = "36500"
+	// legoRunTimeout limits a lego run.
+	legoRunTimeout = 10 * time.Minute
 )
 
+// legoCertPath returns the path of a file lego stored for domain, e.g. ext ".crt" or ".issuer.crt".
+func legoCertPath(domain, ext string) string {
+	return legoCertsPath + "/certificates/" + domain + ext
+}
+
 // GitHubRelease represents the relevant fields from a GitHub release API response.
 type GitHubRelease struct {
 	TagName string `json:"tag_name"`
@@ -252,9 +262,15 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// Causes of a lego run ending before lego exited by itself.
+var (
+	errLegoStopped = errors.New("lego was stopped by the user")
+	errLegoTimeout = errors.New("lego timed out")
+)
+
 var (
 	legoCmd    *exec.Cmd
-	legoCancel context.CancelFunc
+	legoCancel context.CancelCauseFunc
 	legoCmdMu  sync.Mutex
 )
 
@@ -264,7 +280,7 @@ func StopLego(hub *WSHub) error {
 	if legoCmd == nil || legoCmd.Process == nil {
 		return fmt.Errorf("no lego process running")
 	}
-	legoCancel()
+	legoCancel(errLegoStopped)
 	hub.Broadcast(MsgLegoOutput, map[string]string{"line": "--- Process stopped by user ---"})
 	return nil
 }
@@ -275,9 +291,37 @@ func IsLegoRunning() bool {
 	return legoCmd != nil && legoCmd.Process != nil
 }
 
-func RunLego(config *Config, hub *WSHub, command string, logf LogFunc) (string, error) {
+// GetLegoVersion returns the version reported by the installed lego binary.
+func GetLegoVersion() (string, error) {
+	output, err := exec.Command(legoBinaryPath, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run lego --version: %w", err)
+	}
+	// Output format: "lego version 4.21.0 linux/arm64"
+	fields := strings.Fields(string(output))
+	if len(fields) >= 3 && fields[1] == "version" {
+		return fields[2], nil
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// LegoResult describes a finished lego invocation.
+type LegoResult struct {
+	Output     string
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// RunLego runs the given lego command ("obtain" or "renew") and streams its output
+// to the WebSocket hub. A non-empty hook is passed to lego as --run-hook or
+// --renew-hook. The returned result is never nil, even on error.
+func RunLego(config *Config, hub *WSHub, command, hook string, logf LogFunc) (*LegoResult, error) {
+	result := &LegoResult{StartedAt: time.Now(), ExitCode: -1}
+	defer func() { result.FinishedAt = time.Now() }()
+
 	if !IsLegoReady() {
-		return "", fmt.Errorf("lego binary not found, please download first")
+		return result, fmt.Errorf("lego binary not found, please download first")
 	}
 
 	args := []string{
@@ -311,18 +355,25 @@ func RunLego(config *Config, hub *WSHub, command string, logf LogFunc) (string,
 	switch command {
 	case "obtain":
 		args = append(args, "run")
+		if hook != "" {
+			args = append(args, "--run-hook", hook)
+		}
 	case "renew":
 		args = append(args, "renew", "--days", legoRenewAlways)
+		if hook != "" {
+			args = append(args, "--renew-hook", hook)
+		}
 	default:
-		return "", fmt.Errorf("unknown command: %s", command)
+		return result, fmt.Errorf("unknown command: %s", command)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	stopCtx, stop := context.WithCancelCause(context.Background())
+	ctx, cancel := context.WithTimeoutCause(stopCtx, legoRunTimeout, errLegoTimeout)
 	cmd := exec.CommandContext(ctx, legoBinaryPath, args...)
 
 	legoCmdMu.Lock()
 	legoCmd = cmd
-	legoCancel = cancel
+	legoCancel = stop
 	legoCmdMu.Unlock()
 
 	defer func() {
@@ -331,11 +382,12 @@ func RunLego(config *Config, hub *WSHub, command string, logf LogFunc) (string,
 		legoCancel = nil
 		legoCmdMu.Unlock()
 		cancel()
+		stop(nil)
 	}()
 
 	envVars := make(map[string]string)
 	if err := json.Unmarshal([]byte(config.EnvVars), &envVars); err != nil {
-		return "", fmt.Errorf("failed to parse env vars: %w", err)
+		return result, fmt.Errorf("failed to parse env vars: %w", err)
 	}
 
 	cmd.Env = os.Environ()
@@ -345,7 +397,7 @@ func RunLego(config *Config, hub *WSHub, command string, logf LogFunc) (string,
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return "", fmt.Errorf("failed to get stdout pipe: %w", err)
+		return result, fmt.Errorf("failed to get stdout pipe: %w", err)
 	}
 	cmd.Stderr = cmd.Stdout
 
@@ -358,7 +410,8 @@ func RunLego(config *Config, hub *WSHub, command string, logf LogFunc) (string,
 
 	if err := cmd.Start(); err != nil {
 		hub.Broadcast(MsgLegoError, map[string]string{"error": err.Error()})
-		return outputBuf.String(), fmt.Errorf("failed to start lego: %w", err)
+		result.Output = outputBuf.String()
+		return result, fmt.Errorf("failed to start lego: %w", err)
 	}
 
 	scanner := bufio.NewScanner(stdout)
@@ -369,19 +422,22 @@ func RunLego(config *Config, hub *WSHub, command string, logf LogFunc) (string,
 		outputBuf.WriteString(line + "\n")
 	}
 
-	output := outputBuf.String()
+	result.Output = outputBuf.String()
 
-	if err := cmd.Wait(); err != nil {
-		if ctx.Err() != nil {
-			logf("[lego] Process stopped by user")
-			return output, nil
+	err = cmd.Wait()
+	result.ExitCode = cmd.ProcessState.ExitCode()
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			logf("[lego] %s", cause)
+			hub.Broadcast(MsgLegoError, map[string]string{"error": cause.Error()})
+			return result, cause
 		}
 		hub.Broadcast(MsgLegoError, map[string]string{"error": err.Error()})
-		return output, fmt.Errorf("lego exited with error: %w", err)
+		return result, fmt.Errorf("lego exited with error: %w", err)
 	}
 
 	msg := fmt.Sprintf("Certificate %s completed successfully", command)
 	hub.Broadcast(MsgLegoComplete, map[string]string{"message": msg})
 	logf("[lego] %s", msg)
-	return output, nil
+	return result, nil
 }
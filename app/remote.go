@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Push outcomes of a remote device.
+const (
+	PushSuccess = "success"
+	PushFailed  = "failed"
+)
+
+// RemoteDevice is another Axis device on the network the certificate is pushed
+// to after each issuance, e.g. an encoder or door station without DNS credentials.
+type RemoteDevice struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	// Host is host or host:port of the device's HTTPS server.
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	// Password is write-only, it is never returned by the API.
+	Password string `json:"password,omitempty"`
+	// SkipVerify accepts any server certificate, e.g. the device's self-signed one.
+	SkipVerify bool `json:"skip_verify"`
+	Enabled    bool `json:"enabled"`
+	// Domain must be empty or the primary domain: lego issues one certificate
+	// for all domains and stores it under the primary one, which is pushed.
+	Domain string `json:"domain"`
+	// Hostname the certificate must cover. Empty means Host, or the primary
+	// domain if Host is an IP.
+	Hostname       string `json:"hostname"`
+	InstallTargets string `json:"install_targets"`
+	// InstallBackend forces the device's install backend, empty means auto.
+	InstallBackend string `json:"install_backend"`
+	// Result of the last push
+	LastPushAt *time.Time `json:"last_push_at"`
+	LastStatus string     `json:"last_status"`
+	LastError  string     `json:"last_error"`
+	LastSerial string     `json:"last_serial"`
+}
+
+// redacted returns a copy safe to send to clients.
+func (d RemoteDevice) redacted() RemoteDevice {
+	d.Password = ""
+	return d
+}
+
+// installTargets returns the device's own install targets, or the profile of
+// the certificate for domain if the device has none. The default is the web server.
+func (d *RemoteDevice) installTargets(config *Config, domain string) ([]string, error) {
+	if d.InstallTargets == "" {
+		if profiles, err := parseInstallTargetProfiles(config.InstallTargetProfiles); err == nil {
+			if targets, ok := profiles[strings.ToLower(domain)]; ok {
+				return targets, nil
+			}
+		}
+	}
+	return parseInstallTargets(d.InstallTargets)
+}
+
+func (d *RemoteDevice) hostname(domain string) string {
+	if d.Hostname != "" {
+		return d.Hostname
+	}
+	host := d.Host
+	if h, _, err := net.SplitHostPort(d.Host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return domain
+	}
+	return host
+}
+
+// validateDomain checks that Domain is empty or the primary domain. Only that
+// one has a certificate, a device reached by another domain sets Hostname.
+func (d *RemoteDevice) validateDomain(config *Config) error {
+	if d.Domain == "" {
+		return nil
+	}
+	primary := primaryDomain(config)
+	if !strings.EqualFold(d.Domain, primary) {
+		return fmt.Errorf("domain %s is not the primary domain %s, set hostname to reach the device by another name", d.Domain, primary)
+	}
+	d.Domain = primary
+	return nil
+}
+
+// validateRemoteDevice checks a device before it is saved.
+func validateRemoteDevice(d *RemoteDevice, config *Config) error {
+	d.Domain = strings.TrimSpace(d.Domain)
+	if err := d.validateDomain(config); err != nil {
+		return err
+	}
+	d.Host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(d.Host), "https://"), "/")
+	if d.Host == "" || strings.ContainsAny(d.Host, "/?#@ ") {
+		return fmt.Errorf("host must be a host name or address, optionally with port")
+	}
+	if d.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+	if err := validateInstallBackend(d.InstallBackend); err != nil {
+		return err
+	}
+	_, err := parseInstallTargets(d.InstallTargets)
+	return err
+}
+
+func GetRemoteDevices(db *gorm.DB) ([]RemoteDevice, error) {
+	var devices []RemoteDevice
+	if err := db.Order("id").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func GetRemoteDevice(db *gorm.DB, id uint) (*RemoteDevice, error) {
+	var device RemoteDevice
+	if err := db.First(&device, id).Error; err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// pushToDevice installs the certificate to device and stores the outcome on it.
+func (app *LegoApplication) pushToDevice(config *Config, device *RemoteDevice) error {
+	// The domains may have changed since the device was saved. The certificate
+	// covers all of them, install validation checks it covers the device's hostname.
+	err := device.validateDomain(config)
+	domain := primaryDomain(config)
+	var targets []string
+	if err == nil {
+		targets, err = device.installTargets(config, domain)
+	}
+	if err == nil {
+		remote := newRemoteDevice(device.Host, device.Username, device.Password, device.SkipVerify)
+		remote.Backend = device.InstallBackend
+		err = InstallCertToCamera(remote, domain, device.hostname(domain), &HTTPSPolicy{}, targets, func(step InstallStep) {
+			step.Device = device.Name
+			app.wsHub.Broadcast(MsgInstallStep, step)
+		})
+	}
+
+	now := time.Now()
+	device.LastPushAt = &now
+	if err != nil {
+		device.LastStatus = PushFailed
+		device.LastError = err.Error()
+		app.acapp.Syslog.Errorf("Failed to push certificate to %s (%s): %s", device.Name, device.Host, err)
+	} else {
+		device.LastStatus = PushSuccess
+		device.LastError = ""
+		if cert, cerr := loadCertificate(legoCertPath(domain, ".crt")); cerr == nil {
+			device.LastSerial = cert.SerialNumber.String()
+		}
+		app.acapp.Syslog.Infof("Pushed certificate to %s (%s)", device.Name, device.Host)
+	}
+	if serr := app.db.Model(device).Select("LastPushAt", "LastStatus", "LastError", "LastSerial").Updates(device).Error; serr != nil {
+		app.acapp.Syslog.Errorf("Failed to save push status: %s", serr)
+	}
+	app.wsHub.Broadcast(MsgDevicePush, device.redacted())
+	return err
+}
+
+// pushRemoteDevices pushes the certificate with serial to every enabled device
+// that doesn't have it yet.
+func (app *LegoApplication) pushRemoteDevices(serial string) {
+	app.pushMu.Lock()
+	defer app.pushMu.Unlock()
+
+	config, err := GetConfig(app.db)
+	if err != nil {
+		return
+	}
+	devices, err := GetRemoteDevices(app.db)
+	if err != nil {
+		app.acapp.Syslog.Errorf("Failed to load remote devices: %s", err)
+		return
+	}
+	for i := range devices {
+		device := &devices[i]
+		if !device.Enabled {
+			continue
+		}
+		if device.LastStatus == PushSuccess && device.LastSerial == serial {
+			continue
+		}
+		app.pushToDevice(config, device)
+	}
+}
+
+// afterIssued runs after a certificate was obtained, renewed or imported: it
+// archives the certificate, pushes it to the remote devices and runs the
+// deploy hooks.
+func (app *LegoApplication) afterIssued(domain string, run *RunHistory) {
+	if !run.Success || run.CertSerial == "" {
+		return
+	}
+	app.archiveRecorded(domain, run)
+	go app.pushRemoteDevices(run.CertSerial)
+	go app.runDeployHooks(HookOnIssue, domain, run)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateRemoteDeviceDomain(t *testing.T) {
+	config := &Config{Domains: "cam.example.com, door.example.com"}
+	tests := []struct {
+		name   string
+		domain string
+		want   string
+		ok     bool
+	}{
+		{"empty", "", "", true},
+		{"primary", "cam.example.com", "cam.example.com", true},
+		{"case and space", " Cam.Example.com ", "cam.example.com", true},
+		{"SAN", "door.example.com", "", false},
+		{"not configured", "other.example.com", "", false},
+		{"path traversal", "../../etc/passwd", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &RemoteDevice{Host: "10.0.0.2", Username: "root", Domain: tt.domain}
+			err := validateRemoteDevice(d, config)
+			if (err == nil) != tt.ok {
+				t.Fatalf("validateRemoteDevice(%q) error = %v, want ok %v", tt.domain, err, tt.ok)
+			}
+			if tt.ok && d.Domain != tt.want {
+				t.Errorf("Domain = %q, want %q", d.Domain, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteDeviceHostnameCoveredBySAN(t *testing.T) {
+	chain := newTestChain(t, "cam.example.com", "door.example.com")
+	writeLegoCert(t, "cam.example.com", chain)
+	tests := []struct {
+		name   string
+		device RemoteDevice
+		ok     bool
+	}{
+		{"primary by IP", RemoteDevice{Host: "10.0.0.2"}, true},
+		{"SAN as host", RemoteDevice{Host: "door.example.com:8443"}, true},
+		{"SAN as hostname", RemoteDevice{Host: "10.0.0.3", Hostname: "door.example.com"}, true},
+		{"not covered", RemoteDevice{Host: "gate.example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeCamera(t)
+			seedCamera(t, fc)
+			err := InstallCertToCamera(fc.device(BackendSOAP), "cam.example.com", tt.device.hostname("cam.example.com"),
+				&HTTPSPolicy{}, []string{TargetWebServer}, nil)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("install failed: %v", err)
+				}
+				return
+			}
+			var verr *CertValidationError
+			if !errors.As(err, &verr) || verr.Code != ValidationHostnameMismatch {
+				t.Fatalf("error = %v, want %s", err, ValidationHostnameMismatch)
+			}
+			if fc.calledPrefix("SOAP ") {
+				t.Error("contacted the device although the certificate doesn't cover it")
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+// Axis REST configuration APIs used by the REST backend, and their IDs in API
+// discovery.
+const (
+	restCertAPI            = "cert"
+	restWebServerAPI       = "web-server"
+	restCertificatesPath   = "/config/rest/cert/v1/certificates"
+	restCACertificatesPath = "/config/rest/cert/v1/ca_certificates"
+	restWebServerTLSPath   = "/config/rest/web-server/v1/tls_configuration"
+)
+
+var restRequiredAPIs = []string{restCertAPI, restWebServerAPI}
+
+// restBackend manages certificates via the Axis REST configuration APIs.
+var restBackend = certBackend{
+	name:               BackendREST,
+	listCertificates:   restListCertificates,
+	listCACertificates: restListCACertificates,
+	loadCertificate:    restLoadCertificate,
+	loadCACertificate:  restLoadCACertificate,
+	deleteCertificate:  restDeleteCertificate,
+	getWebServerTLS:    restGetWebServerTLS,
+	setWebServerTLS:    restSetWebServerTLS,
+}
+
+// RESTError is an error returned by an Axis REST API.
+type RESTError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RESTError) Error() string {
+	return fmt.Sprintf("REST error %d: %s", e.Code, e.Message)
+}
+
+// restCall sends a request to a REST API of dev. Payloads are wrapped in
+// {"data": ...}, request and response may be nil.
+func restCall(dev *Device, method, path string, request, response any) error {
+	var payload []byte
+	if request != nil {
+		var err error
+		if payload, err = json.Marshal(map[string]any{"data": request}); err != nil {
+			return err
+		}
+	}
+	resp, err := dev.do(method, path, "application/json", payload)
+	if err != nil {
+		return fmt.Errorf("REST request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	var envelope struct {
+		Data  json.RawMessage `json:"data"`
+		Error *RESTError      `json:"error"`
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &envelope); err != nil && resp.StatusCode/100 == 2 {
+			return fmt.Errorf("invalid REST response: %w", err)
+		}
+	}
+	if envelope.Error != nil {
+		return envelope.Error
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("REST request returned status %d", resp.StatusCode)
+	}
+	if response != nil && len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, response); err != nil {
+			return fmt.Errorf("failed to parse REST response: %w", err)
+		}
+	}
+	return nil
+}
+
+// restCertificate is a certificate in the REST API, PEM encoded.
+type restCertificate struct {
+	ID          string `json:"id"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key,omitempty"`
+}
+
+func restListCertificates(dev *Device) ([]certificateEntry, error) {
+	return restListStore(dev, restCertificatesPath)
+}
+
+func restListCACertificates(dev *Device) ([]certificateEntry, error) {
+	return restListStore(dev, restCACertificatesPath)
+}
+
+// restListStore lists the certificate store at path.
+func restListStore(dev *Device, path string) ([]certificateEntry, error) {
+	var certs []restCertificate
+	if err := restCall(dev, "GET", path, nil, &certs); err != nil {
+		return nil, err
+	}
+	entries := make([]certificateEntry, 0, len(certs))
+	for _, c := range certs {
+		entry := certificateEntry{ID: c.ID}
+		if block, _ := pem.Decode([]byte(c.Certificate)); block != nil {
+			entry.Data = base64.StdEncoding.EncodeToString(block.Bytes)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func restLoadCertificate(dev *Device, id string, cert, key []byte) error {
+	return restCall(dev, "POST", restCertificatesPath, restCertificate{
+		ID:          id,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})),
+	}, nil)
+}
+
+func restLoadCACertificate(dev *Device, id string, cert []byte) error {
+	return restCall(dev, "POST", restCACertificatesPath, restCertificate{
+		ID:          id,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})),
+	}, nil)
+}
+
+// restDeleteCertificate deletes id from the store it is in.
+func restDeleteCertificate(dev *Device, id string) error {
+	cas, err := restListCACertificates(dev)
+	if err != nil {
+		return fmt.Errorf("failed to list CA certificates: %w", err)
+	}
+	path := restCertificatesPath
+	for _, c := range cas {
+		if c.ID == id {
+			path = restCACertificatesPath
+			break
+		}
+	}
+	return restCall(dev, "DELETE", path+"/"+url.PathEscape(id), nil, nil)
+}
+
+func restGetWebServerTLS(dev *Device) (*webServerTlsConfiguration, error) {
+	var config webServerTlsConfiguration
+	if err := restCall(dev, "GET", restWebServerTLSPath, nil, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func restSetWebServerTLS(dev *Device, c *webServerTlsConfiguration) error {
+	return restCall(dev, "PUT", restWebServerTLSPath, c, nil)
+}
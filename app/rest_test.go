@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRestCall(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  any
+		status   int
+		body     string
+		wantSent string
+		want     string
+		wantErr  string
+		wantCode int
+	}{
+		{"data envelope", map[string]int{"x": 1}, 200, `{"data": {"id": "lego-1"}}`, `{"data":{"x":1}}`, "lego-1", "", 0},
+		{"no request", nil, 200, `{"data": {"id": "lego-2"}}`, ``, "lego-2", "", 0},
+		{"empty response", nil, 204, ``, ``, "", "", 0},
+		{"error envelope", nil, 400, `{"error": {"code": 2101, "message": "Invalid certificate"}}`, ``, "", "REST error 2101: Invalid certificate", 2101},
+		{"error envelope with status 200", nil, 200, `{"error": {"code": 2000, "message": "Busy"}}`, ``, "", "REST error 2000: Busy", 2000},
+		{"status without body", nil, 500, ``, ``, "", "REST request returned status 500", 0},
+		{"status with HTML body", nil, 502, `<html>Bad Gateway</html>`, ``, "", "REST request returned status 502", 0},
+		{"invalid JSON", nil, 200, `not json`, ``, "", "invalid REST response", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				sent = string(body)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+			dev := &Device{BaseURL: server.URL, client: server.Client()}
+
+			var response restCertificate
+			err := restCall(dev, "POST", restCertificatesPath, tt.request, &response)
+			if sent != tt.wantSent {
+				t.Errorf("sent %q, want %q", sent, tt.wantSent)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if response.ID != tt.want {
+					t.Errorf("response ID = %q, want %q", response.ID, tt.want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			var restErr *RESTError
+			if errors.As(err, &restErr) != (tt.wantCode != 0) || (restErr != nil && restErr.Code != tt.wantCode) {
+				t.Errorf("error = %#v, want REST error code %d", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRestLoadCertificateSendsPEM(t *testing.T) {
+	fc := newFakeCamera(t)
+	chain := newTestChain(t, "cam.example.com")
+	fc.addCert("lego-1", chain.leaf, chain.leafKey)
+	entry := fc.certs["lego-1"]
+	delete(fc.certs, "lego-1")
+
+	dev := fc.device(BackendREST)
+	if err := restLoadCertificate(dev, "lego-1", entry.der, entry.key); err != nil {
+		t.Fatal(err)
+	}
+	fc.mu.Lock()
+	stored := fc.certs["lego-1"]
+	fc.mu.Unlock()
+	if string(stored.der) != string(entry.der) || string(stored.key) != string(entry.key) {
+		t.Error("certificate or key changed on the way to the camera")
+	}
+
+	entries, err := restListCertificates(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := certificateIDs(entries); !slices.Contains(ids, "lego-1") {
+		t.Errorf("listed %v, want lego-1", ids)
+	}
+}
+
+func TestRestDeleteCertificateListError(t *testing.T) {
+	fc := newFakeCamera(t)
+	seedCamera(t, fc)
+	fc.fail["GET "+restCACertificatesPath] = 503
+
+	err := restDeleteCertificate(fc.device(BackendREST), "lego-200101000000")
+	if err == nil || !strings.Contains(err.Error(), "failed to list CA certificates") {
+		t.Fatalf("error = %v, want the CA list error", err)
+	}
+	if fc.calledPrefix("DELETE ") {
+		t.Error("deleted although the store of the certificate is unknown")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	retryBaseDelay = 15 * time.Minute
+	retryMaxDelay  = 12 * time.Hour
+)
+
+// RetryState persists the auto-renew backoff so it survives app restarts.
+// Only a single row is stored.
+type RetryState struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	Failures    int       `json:"failures"`
+	NextRetryAt time.Time `json:"next_retry_at"`
+	LastError   string    `json:"last_error"`
+}
+
+var (
+	// ACME rate limit errors, e.g. "retry after 2024-01-18 15:08:16 UTC"
+	retryAfterTimeRe = regexp.MustCompile(`(?i)retry[- ]after:?\s*(\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2})`)
+	// HTTP Retry-After header as a date, e.g. "Retry-After: Wed, 21 Oct 2015 07:28:00 GMT"
+	retryAfterDateRe = regexp.MustCompile(`(?i)retry-after:?\s*([a-z]{3}, \d{2} [a-z]{3} \d{4} \d{2}:\d{2}:\d{2} GMT)`)
+	// HTTP Retry-After header in seconds, e.g. "Retry-After: 3600"
+	retryAfterSecondsRe = regexp.MustCompile(`(?i)retry-after:?\s*(\d+)\b`)
+)
+
+func GetRetryState(db *gorm.DB) (*RetryState, error) {
+	var state RetryState
+	if err := db.FirstOrInit(&state).Error; err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// backingOff reports whether lego must not run yet because earlier runs failed.
+func (s *RetryState) backingOff(now time.Time) bool {
+	return s.Failures > 0 && now.Before(s.NextRetryAt)
+}
+
+// RecordRenewFailure increments the failure count and schedules the next retry.
+func RecordRenewFailure(db *gorm.DB, output string, renewErr error) (*RetryState, error) {
+	state, err := GetRetryState(db)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	state.Failures++
+	state.NextRetryAt = now.Add(retryDelay(state.Failures, output, now))
+	state.LastError = renewErr.Error()
+	return state, db.Save(state).Error
+}
+
+// ResetRetryState clears the backoff after a successful renewal.
+func ResetRetryState(db *gorm.DB) error {
+	return db.Where("1 = 1").Delete(&RetryState{}).Error
+}
+
+// retryDelay returns the exponential backoff for the given number of consecutive
+// failures, capped at retryMaxDelay. A longer rate-limit hint from the CA wins.
+func retryDelay(failures int, output string, now time.Time) time.Duration {
+	delay := retryMaxDelay
+	if failures < 16 {
+		delay = min(retryBaseDelay<<(failures-1), retryMaxDelay)
+	}
+	if hint, ok := parseRetryAfter(output, now); ok && hint > delay {
+		delay = hint
+	}
+	return delay
+}
+
+// parseRetryAfter looks for a CA rate-limit hint in lego output and returns
+// how long to wait from now.
+func parseRetryAfter(output string, now time.Time) (time.Duration, bool) {
+	if m := retryAfterTimeRe.FindStringSubmatch(output); m != nil {
+		at, err := time.Parse("2006-01-02 15:04:05", m[1])
+		if err != nil {
+			at, err = time.Parse("2006-01-02T15:04:05", m[1])
+		}
+		if err == nil && at.After(now) {
+			return at.Sub(now), true
+		}
+	}
+	if m := retryAfterDateRe.FindStringSubmatch(output); m != nil {
+		if at, err := http.ParseTime(m[1]); err == nil && at.After(now) {
+			return at.Sub(now), true
+		}
+	}
+	if m := retryAfterSecondsRe.FindStringSubmatch(output); m != nil {
+		if seconds, err := strconv.Atoi(m[1]); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
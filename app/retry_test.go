@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		output string
+		want   time.Duration
+		ok     bool
+	}{
+		{"seconds", "Retry-After: 3600", time.Hour, true},
+		{"seconds without colon", "retry-after 90", 90 * time.Second, true},
+		{"http date", "Retry-After: Thu, 18 Jan 2024 14:30:00 GMT", 150 * time.Minute, true},
+		{"acme time", "too many certificates, retry after 2024-01-18 15:08:16 UTC", 3*time.Hour + 8*time.Minute + 16*time.Second, true},
+		{"acme time with T", "retry after 2024-01-18T13:00:00", time.Hour, true},
+		{"date in the past", "Retry-After: Wed, 17 Jan 2024 10:00:00 GMT", 0, false},
+		{"zero seconds", "Retry-After: 0", 0, false},
+		{"no hint", "acme: error: 500", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.output, now)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.output, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	now := time.Date(2024, 1, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		failures int
+		output   string
+		want     time.Duration
+	}{
+		{"first failure", 1, "", 15 * time.Minute},
+		{"second failure", 2, "", 30 * time.Minute},
+		{"sixth failure", 6, "", 8 * time.Hour},
+		{"capped", 7, "", 12 * time.Hour},
+		{"capped without overflow", 100, "", 12 * time.Hour},
+		{"longer hint wins", 1, "Retry-After: 7200", 2 * time.Hour},
+		{"shorter hint ignored", 3, "Retry-After: 60", time.Hour},
+		{"hint beyond cap wins", 7, "Retry-After: Fri, 19 Jan 2024 12:00:00 GMT", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryDelay(tt.failures, tt.output, now); got != tt.want {
+				t.Errorf("retryDelay(%d, %q) = %s, want %s", tt.failures, tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryStateBackingOff(t *testing.T) {
+	now := time.Date(2024, 1, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state RetryState
+		want  bool
+	}{
+		{"no failures", RetryState{}, false},
+		{"retry due later", RetryState{Failures: 1, NextRetryAt: now.Add(time.Hour)}, true},
+		{"hint beyond check interval", RetryState{Failures: 1, NextRetryAt: now.Add(48 * time.Hour)}, true},
+		{"retry due", RetryState{Failures: 2, NextRetryAt: now}, false},
+		{"retry overdue", RetryState{Failures: 2, NextRetryAt: now.Add(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.backingOff(now); got != tt.want {
+				t.Errorf("backingOff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
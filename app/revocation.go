@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Revocation states of the local certificate.
+const (
+	RevocationGood    = "good"
+	RevocationRevoked = "revoked"
+	RevocationUnknown = "unknown"
+)
+
+// RevocationStatus is the result of an OCSP or CRL lookup for the local certificate.
+type RevocationStatus struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Serial    string    `json:"serial"`
+	Status    string    `json:"status"`
+	// Source is "ocsp" or "crl", empty if no lookup succeeded.
+	Source    string     `json:"source,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// checkRevocation queries the OCSP responder of the local certificate for domain,
+// or its CRL when the certificate has no OCSP responder.
+func checkRevocation(domain string) *RevocationStatus {
+	status := &RevocationStatus{CheckedAt: time.Now(), Status: RevocationUnknown}
+
+	chain, err := loadChain(domain)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	cert := chain[0]
+	status.Serial = cert.SerialNumber.String()
+	if len(chain) < 2 {
+		status.Error = "issuer certificate not available"
+		return status
+	}
+	issuer := chain[1]
+
+	switch {
+	case len(cert.OCSPServer) > 0:
+		status.Source = "ocsp"
+		err = checkOCSP(cert, issuer, status)
+	case len(cert.CRLDistributionPoints) > 0:
+		status.Source = "crl"
+		err = checkCRL(cert, issuer, status)
+	default:
+		err = fmt.Errorf("certificate has neither OCSP responder nor CRL")
+	}
+	if err != nil {
+		status.Status = RevocationUnknown
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func checkOCSP(cert, issuer *x509.Certificate, status *RevocationStatus) error {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+	resp, err := httpAPIClient.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return fmt.Errorf("OCSP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read OCSP response: %w", err)
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	switch parsed.Status {
+	case ocsp.Good:
+		status.Status = RevocationGood
+	case ocsp.Revoked:
+		status.Status = RevocationRevoked
+		revokedAt := parsed.RevokedAt
+		status.RevokedAt = &revokedAt
+	default:
+		status.Status = RevocationUnknown
+	}
+	return nil
+}
+
+func checkCRL(cert, issuer *x509.Certificate, status *RevocationStatus) error {
+	resp, err := httpAPIClient.Get(cert.CRLDistributionPoints[0])
+	if err != nil {
+		return fmt.Errorf("CRL download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CRL download returned status %d", resp.StatusCode)
+	}
+	der, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read CRL: %w", err)
+	}
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return fmt.Errorf("invalid CRL: %w", err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("CRL signature invalid: %w", err)
+	}
+
+	status.Status = RevocationGood
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			status.Status = RevocationRevoked
+			revokedAt := entry.RevocationTime
+			status.RevokedAt = &revokedAt
+			break
+		}
+	}
+	return nil
+}
+
+// refreshRevocation checks the revocation state of the local certificate and
+// stores the result for GET /api/cert.
+func (app *LegoApplication) refreshRevocation(domain string) *RevocationStatus {
+	status := checkRevocation(domain)
+	if status.Status == RevocationRevoked {
+		app.acapp.Syslog.Warnf("Certificate %s for %s has been revoked", status.Serial, domain)
+	}
+	app.revocationMu.Lock()
+	app.lastRevocation = status
+	app.revocationMu.Unlock()
+	return status
+}
+
+func (app *LegoApplication) getLastRevocation() *RevocationStatus {
+	app.revocationMu.Lock()
+	defer app.revocationMu.Unlock()
+	return app.lastRevocation
+}
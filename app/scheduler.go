@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	// autoRenewStartupDelay gives the lego download time to finish on first boot.
+	autoRenewStartupDelay = 30 * time.Second
+
+	defaultCheckIntervalHours = 24
+)
+
+// Outcomes of a scheduled check.
+const (
+	CheckSkipped  = "skipped"
+	CheckNoAction = "no_action"
+	CheckSuccess  = "success"
+	CheckFailed   = "failed"
+)
+
+// CheckOutcome records when a scheduled check ran, what it decided and why.
+type CheckOutcome struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Outcome   string    `json:"outcome"`
+	// Action is the ensure action, empty if the check was skipped early.
+	Action string `json:"action,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ScheduleState is the scheduler state exposed by GET /api/schedule.
+type ScheduleState struct {
+	AutoMode  bool          `json:"auto_mode"`
+	NextCheck time.Time     `json:"next_check"`
+	LastCheck *CheckOutcome `json:"last_check"`
+	Retry     *RetryState   `json:"retry,omitempty"`
+}
+
+// Schedule holds the auto-renew scheduler settings taken from the config.
+type Schedule struct {
+	Interval time.Duration
+	// Hours lists the preferred hours of the day (0-23). Empty means any hour.
+	Hours  []int
+	Jitter time.Duration
+}
+
+// ScheduleFromConfig builds the scheduler settings from config.
+// Invalid preferred hours are ignored, SaveConfig rejects them beforehand.
+func ScheduleFromConfig(config *Config) Schedule {
+	hours, _ := parseCheckHours(config.CheckHours)
+	return Schedule{
+		Interval: time.Duration(config.CheckIntervalHours) * time.Hour,
+		Hours:    hours,
+		Jitter:   time.Duration(config.CheckJitterMinutes) * time.Minute,
+	}
+}
+
+// parseCheckHours parses a comma-separated list of hours like "2,3,4".
+func parseCheckHours(value string) ([]int, error) {
+	var hours []int
+	for _, part := range splitDomains(value) {
+		hour, err := strconv.Atoi(part)
+		if err != nil || hour < 0 || hour > 23 {
+			return nil, fmt.Errorf("invalid check hour %q, expected 0-23", part)
+		}
+		hours = append(hours, hour)
+	}
+	return hours, nil
+}
+
+// validateSchedule checks the intervals of the scheduler and background checks before a config is saved.
+func validateSchedule(config *Config) error {
+	if config.CheckIntervalHours < 0 {
+		return fmt.Errorf("check interval must not be negative")
+	}
+	if config.CheckJitterMinutes < 0 {
+		return fmt.Errorf("check jitter must not be negative")
+	}
+	if config.DriftCheckMinutes < 0 {
+		return fmt.Errorf("drift check interval must not be negative")
+	}
+	if config.CTCheckHours < 0 {
+		return fmt.Errorf("CT check interval must not be negative")
+	}
+	_, err := parseCheckHours(config.CheckHours)
+	return err
+}
+
+// Next returns when the next check should run. last is the time of the previous
+// check, or zero if no check ran yet since startup.
+func (s Schedule) Next(last, now time.Time) time.Time {
+	next := now.Add(autoRenewStartupDelay)
+	if !last.IsZero() {
+		next = last.Add(s.Interval)
+		if next.Before(now) {
+			next = now
+		}
+	}
+	next = s.alignToHours(next)
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	return next
+}
+
+// alignToHours moves t forward to the start of the next preferred hour,
+// unless t already falls into one.
+func (s Schedule) alignToHours(t time.Time) time.Time {
+	if len(s.Hours) == 0 {
+		return t
+	}
+	candidate := t
+	for i := 0; i < 24; i++ {
+		for _, hour := range s.Hours {
+			if candidate.Hour() == hour {
+				return candidate
+			}
+		}
+		candidate = candidate.Truncate(time.Hour).Add(time.Hour)
+	}
+	return t
+}
+
+// startAutoRenew starts the scheduler loop that runs checkAndAutoRenew.
+// Config changes take effect through rescheduleAutoRenew without a restart.
+func (app *LegoApplication) startAutoRenew() {
+	app.autoRenewReschedule = make(chan struct{}, 1)
+	go app.autoRenewLoop()
+}
+
+// rescheduleAutoRenew makes the scheduler recompute its next run from the current config.
+func (app *LegoApplication) rescheduleAutoRenew() {
+	select {
+	case app.autoRenewReschedule <- struct{}{}:
+	default:
+	}
+}
+
+func (app *LegoApplication) loadSchedule() Schedule {
+	config, err := GetConfig(app.db)
+	if err != nil {
+		return Schedule{Interval: defaultCheckIntervalHours * time.Hour}
+	}
+	return ScheduleFromConfig(config)
+}
+
+// nextAutoRenewRun returns the next scheduled check, or the pending retry of a
+// failed auto-renewal if that comes first. A retry is pending until a check ran
+// after its due time.
+func (app *LegoApplication) nextAutoRenewRun(last time.Time) time.Time {
+	now := time.Now()
+	next := app.loadSchedule().Next(last, now)
+	retry, err := GetRetryState(app.db)
+	if err == nil && retry.Failures > 0 && retry.NextRetryAt.After(last) && retry.NextRetryAt.Before(next) {
+		next = retry.NextRetryAt
+		if next.Before(now) {
+			next = now
+		}
+	}
+	return next
+}
+
+func (app *LegoApplication) autoRenewLoop() {
+	var last time.Time
+	next := app.nextAutoRenewRun(last)
+	for {
+		app.setNextCheck(next)
+		app.acapp.Syslog.Infof("Next certificate check scheduled at %s", next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-app.shutdown:
+			timer.Stop()
+			return
+		case <-app.autoRenewReschedule:
+			timer.Stop()
+		case <-timer.C:
+			outcome := app.checkAndAutoRenew()
+			app.acapp.Syslog.Infof("Certificate check: %s (%s)", outcome.Outcome, outcome.Reason)
+			app.setLastCheck(outcome)
+			last = time.Now()
+		}
+		next = app.nextAutoRenewRun(last)
+	}
+}
+
+func (app *LegoApplication) setNextCheck(next time.Time) {
+	app.scheduleMu.Lock()
+	app.nextCheck = next
+	app.scheduleMu.Unlock()
+	app.wsHub.Broadcast(MsgSchedule, app.scheduleState())
+}
+
+func (app *LegoApplication) setLastCheck(outcome *CheckOutcome) {
+	app.scheduleMu.Lock()
+	app.lastCheck = outcome
+	app.scheduleMu.Unlock()
+}
+
+// scheduleState returns the current scheduler state including any pending retry.
+func (app *LegoApplication) scheduleState() *ScheduleState {
+	app.scheduleMu.Lock()
+	state := &ScheduleState{NextCheck: app.nextCheck, LastCheck: app.lastCheck}
+	app.scheduleMu.Unlock()
+
+	if config, err := GetConfig(app.db); err == nil {
+		state.AutoMode = config.AutoMode
+	}
+	if retry, err := GetRetryState(app.db); err == nil && retry.Failures > 0 {
+		state.Retry = retry
+	}
+	return state
+}
+
+// runEvery calls fn after each interval until the app shuts down. The interval
+// is re-evaluated before every wait, so config changes apply without a restart.
+func (app *LegoApplication) runEvery(interval func() time.Duration, fn func()) {
+	for {
+		timer := time.NewTimer(interval())
+		select {
+		case <-app.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+			fn()
+		}
+	}
+}
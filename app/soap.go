@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Request types carry their namespaces for marshalling. Response types match
+// elements by local name, so the prefixes a camera uses don't matter.
+
+type soapRequestEnvelope struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2003/05/soap-envelope Envelope"`
+	Body    struct {
+		Content any
+	} `xml:"http://www.w3.org/2003/05/soap-envelope Body"`
+}
+
+type soapResponseEnvelope struct {
+	Body struct {
+		Fault   *SOAPFault `xml:"Fault"`
+		Content []byte     `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// SOAPFault is a SOAP 1.2 fault returned by the camera.
+type SOAPFault struct {
+	// Code is e.g. "SOAP-ENV:Sender", Subcode e.g. "ter:InvalidArgVal".
+	Code    string `xml:"Code>Value"`
+	Subcode string `xml:"Code>Subcode>Value"`
+	Reason  string `xml:"Reason>Text"`
+	Detail  string `xml:"Detail>Text"`
+}
+
+func (f *SOAPFault) Error() string {
+	msg := strings.TrimSpace(f.Reason)
+	if msg == "" {
+		msg = "SOAP fault"
+		if f.Subcode != "" {
+			msg += " " + strings.TrimSpace(f.Subcode)
+		}
+	}
+	if detail := strings.TrimSpace(f.Detail); detail != "" {
+		msg += ": " + detail
+	}
+	return msg
+}
+
+// HasSubcode reports whether the fault subcode has the given local name, e.g.
+// "ActionNotSupported" for "ter:ActionNotSupported".
+func (f *SOAPFault) HasSubcode(name string) bool {
+	subcode := strings.TrimSpace(f.Subcode)
+	if i := strings.LastIndex(subcode, ":"); i >= 0 {
+		subcode = subcode[i+1:]
+	}
+	return subcode == name
+}
+
+// marshalSOAPRequest wraps request in a SOAP envelope.
+func marshalSOAPRequest(request any) ([]byte, error) {
+	var envelope soapRequestEnvelope
+	envelope.Body.Content = request
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(envelope); err != nil {
+		return nil, fmt.Errorf("failed to encode SOAP request: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalSOAPResponse decodes a SOAP response into response, which may be nil.
+// A fault is returned as *SOAPFault.
+func unmarshalSOAPResponse(data []byte, response any) error {
+	var envelope soapResponseEnvelope
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("invalid SOAP response: %w", err)
+	}
+	if envelope.Body.Fault != nil {
+		return envelope.Body.Fault
+	}
+	if response == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(envelope.Body.Content, response); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to parse SOAP response: %w", err)
+	}
+	return nil
+}
+
+// ONVIF device service
+
+type onvifBinaryData struct {
+	Data string `xml:"http://www.onvif.org/ver10/schema Data"`
+}
+
+type loadCertificateWithPrivateKeyRequest struct {
+	XMLName                   xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl LoadCertificateWithPrivateKey"`
+	CertificateWithPrivateKey struct {
+		CertificateID string          `xml:"http://www.onvif.org/ver10/schema CertificateID"`
+		Certificate   onvifBinaryData `xml:"http://www.onvif.org/ver10/schema Certificate"`
+		PrivateKey    onvifBinaryData `xml:"http://www.onvif.org/ver10/schema PrivateKey"`
+	} `xml:"http://www.onvif.org/ver10/device/wsdl CertificateWithPrivateKey"`
+}
+
+type onvifCertificate struct {
+	CertificateID string          `xml:"http://www.onvif.org/ver10/schema CertificateID"`
+	Certificate   onvifBinaryData `xml:"http://www.onvif.org/ver10/schema Certificate"`
+}
+
+type loadCACertificatesRequest struct {
+	XMLName       xml.Name           `xml:"http://www.onvif.org/ver10/device/wsdl LoadCACertificates"`
+	CACertificate []onvifCertificate `xml:"http://www.onvif.org/ver10/device/wsdl CACertificate"`
+}
+
+type getCertificatesRequest struct {
+	XMLName xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl GetCertificates"`
+}
+
+type getCACertificatesRequest struct {
+	XMLName xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl GetCACertificates"`
+}
+
+// certificateEntry is a certificate in a GetCertificates or GetCACertificates response.
+type certificateEntry struct {
+	ID   string `xml:"CertificateID"`
+	Data string `xml:"Certificate>Data"`
+}
+
+type getCertificatesResponse struct {
+	Certificates []certificateEntry `xml:"NvtCertificate"`
+}
+
+type getCACertificatesResponse struct {
+	Certificates []certificateEntry `xml:"CACertificate"`
+}
+
+type deleteCertificatesRequest struct {
+	XMLName       xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl DeleteCertificates"`
+	CertificateID []string `xml:"http://www.onvif.org/ver10/device/wsdl CertificateID"`
+}
+
+type getDot1XConfigurationsRequest struct {
+	XMLName xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl GetDot1XConfigurations"`
+}
+
+type getDot1XConfigurationsResponse struct {
+	Configurations []dot1XConfiguration `xml:"Dot1XConfiguration"`
+}
+
+type setDot1XConfigurationRequest struct {
+	XMLName            xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl SetDot1XConfiguration"`
+	Dot1XConfiguration struct {
+		Token                  string   `xml:"http://www.onvif.org/ver10/schema Dot1XConfigurationToken"`
+		Identity               string   `xml:"http://www.onvif.org/ver10/schema Identity"`
+		AnonymousID            string   `xml:"http://www.onvif.org/ver10/schema AnonymousID,omitempty"`
+		EAPMethod              int      `xml:"http://www.onvif.org/ver10/schema EAPMethod"`
+		CACertificateID        []string `xml:"http://www.onvif.org/ver10/schema CACertificateID"`
+		EAPMethodConfiguration struct {
+			TLSConfiguration struct {
+				CertificateID string `xml:"http://www.onvif.org/ver10/schema CertificateID"`
+			} `xml:"http://www.onvif.org/ver10/schema TLSConfiguration"`
+		} `xml:"http://www.onvif.org/ver10/schema EAPMethodConfiguration"`
+	} `xml:"http://www.onvif.org/ver10/device/wsdl Dot1XConfiguration"`
+}
+
+// Axis web server service
+
+type getWebServerTlsConfigurationRequest struct {
+	XMLName xml.Name `xml:"http://www.axis.com/vapix/ws/webserver GetWebServerTlsConfiguration"`
+}
+
+type getWebServerTlsConfigurationResponse struct {
+	Configuration webServerTlsConfiguration `xml:"Configuration"`
+}
+
+type axisIDList struct {
+	ID []string `xml:"http://www.axis.com/vapix/ws/cert Id"`
+}
+
+type setWebServerTlsConfigurationRequest struct {
+	XMLName       xml.Name `xml:"http://www.axis.com/vapix/ws/webserver SetWebServerTlsConfiguration"`
+	Configuration struct {
+		Tls                bool `xml:"http://www.axis.com/vapix/ws/webserver Tls"`
+		ConnectionPolicies struct {
+			Admin    string `xml:"http://www.axis.com/vapix/ws/webserver Admin,omitempty"`
+			Operator string `xml:"http://www.axis.com/vapix/ws/webserver Operator,omitempty"`
+			Viewer   string `xml:"http://www.axis.com/vapix/ws/webserver Viewer,omitempty"`
+		} `xml:"http://www.axis.com/vapix/ws/webserver ConnectionPolicies"`
+		Ciphers struct {
+			Cipher []string `xml:"http://www.axis.com/vapix/ws/cert Cipher"`
+		} `xml:"http://www.axis.com/vapix/ws/webserver Ciphers"`
+		CertificateSet struct {
+			Certificates        axisIDList `xml:"http://www.axis.com/vapix/ws/cert Certificates"`
+			CACertificates      axisIDList `xml:"http://www.axis.com/vapix/ws/cert CACertificates"`
+			TrustedCertificates axisIDList `xml:"http://www.axis.com/vapix/ws/cert TrustedCertificates"`
+		} `xml:"http://www.axis.com/vapix/ws/webserver CertificateSet"`
+	} `xml:"http://www.axis.com/vapix/ws/webserver Configuration"`
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/Cacsjep/goxis/pkg/vapix"
+)
+
+// Camera services the certificate can be installed to.
+const (
+	TargetWebServer = "webserver"
+	TargetMQTT      = "mqtt"
+	TargetDot1X     = "dot1x"
+)
+
+// errTargetUnsupported is returned when the firmware lacks the API of a target.
+var errTargetUnsupported = errors.New("not supported by this firmware")
+
+// bindRequest is what a target binds to: the uploaded certificate, its
+// intermediates and, for the web server, the HTTPS policy.
+type bindRequest struct {
+	certID string
+	caIDs  []string
+	policy *HTTPSPolicy
+}
+
+// installTarget is a TLS consumer on the camera.
+type installTarget struct {
+	// bind makes the service use the certificate in req.
+	bind func(dev *Device, req *bindRequest) error
+	// boundCerts returns the certificate IDs the service uses, so cleanup
+	// doesn't delete them.
+	boundCerts func(dev *Device) ([]string, error)
+	// snapshot records the current binding, so a failed install can restore it.
+	snapshot func(dev *Device) (*targetSnapshot, error)
+}
+
+var installTargets = map[string]installTarget{
+	TargetWebServer: {bindWebServer, webServerCerts, snapshotWebServer},
+	TargetMQTT:      {bindMQTT, mqttCerts, snapshotMQTT},
+	TargetDot1X:     {bindDot1X, dot1XCerts, snapshotDot1X},
+}
+
+// targetSnapshot is the binding of a target before an install.
+type targetSnapshot struct {
+	target string
+	// certID is the certificate the target used, empty if none.
+	certID  string
+	restore func() error
+}
+
+// parseInstallTargets splits a comma-separated target list. Empty means the
+// web server only.
+func parseInstallTargets(targets string) ([]string, error) {
+	var out []string
+	for _, t := range strings.Split(targets, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || slices.Contains(out, t) {
+			continue
+		}
+		if _, ok := installTargets[t]; !ok {
+			return nil, fmt.Errorf("unknown install target %q", t)
+		}
+		out = append(out, t)
+	}
+	if len(out) == 0 {
+		out = []string{TargetWebServer}
+	}
+	return out, nil
+}
+
+// parseInstallTargetProfiles parses the per-certificate install targets: a JSON
+// object mapping the domain of a certificate to a comma-separated target list.
+func parseInstallTargetProfiles(profiles string) (map[string][]string, error) {
+	out := make(map[string][]string)
+	if strings.TrimSpace(profiles) == "" {
+		return out, nil
+	}
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(profiles), &raw); err != nil {
+		return nil, fmt.Errorf("invalid install target profiles: %w", err)
+	}
+	for domain, targets := range raw {
+		parsed, err := parseInstallTargets(targets)
+		if err != nil {
+			return nil, fmt.Errorf("install targets of %s: %w", domain, err)
+		}
+		out[strings.ToLower(strings.TrimSpace(domain))] = parsed
+	}
+	return out, nil
+}
+
+// installTargetsFor returns the install targets of the certificate for
+// domain: its profile if it has one, InstallTargets otherwise.
+func installTargetsFor(config *Config, domain string) ([]string, error) {
+	profiles, err := parseInstallTargetProfiles(config.InstallTargetProfiles)
+	if err != nil {
+		return nil, err
+	}
+	if targets, ok := profiles[strings.ToLower(domain)]; ok {
+		return targets, nil
+	}
+	return parseInstallTargets(config.InstallTargets)
+}
+
+// validateInstallTargets checks the install targets and profiles before a
+// config is saved. lego issues one certificate, stored under the primary
+// domain, so that is the only domain a profile can be for.
+func validateInstallTargets(config *Config) error {
+	if _, err := parseInstallTargets(config.InstallTargets); err != nil {
+		return err
+	}
+	profiles, err := parseInstallTargetProfiles(config.InstallTargetProfiles)
+	if err != nil {
+		return err
+	}
+	primary := strings.ToLower(primaryDomain(config))
+	for domain := range profiles {
+		if domain != primary {
+			return fmt.Errorf("install target profile for %s, only the primary domain %s has a certificate", domain, primary)
+		}
+	}
+	return nil
+}
+
+// boundCertificateIDs collects the certificate IDs used by every target the
+// firmware supports. An error means the bindings are not fully known.
+func boundCertificateIDs(dev *Device) ([]string, error) {
+	var ids []string
+	for name, target := range installTargets {
+		bound, err := target.boundCerts(dev)
+		if errors.Is(err, errTargetUnsupported) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ids = append(ids, bound...)
+	}
+	return ids, nil
+}
+
+// bindWebServer points HTTPS at the certificate, keeping any setting the policy
+// doesn't override, and verifies the result.
+func bindWebServer(dev *Device, req *bindRequest) error {
+	tlsConfig, err := getWebServerTlsConfiguration(dev)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTPS configuration: %w", err)
+	}
+	var available []string
+	if len(req.policy.Ciphers) > 0 {
+		if available, err = fetchSupportedCiphers(dev); err != nil {
+			return err
+		}
+	}
+	if err := req.policy.apply(tlsConfig, available); err != nil {
+		return err
+	}
+	tlsConfig.CertificateSet.Certificates = []string{req.certID}
+	tlsConfig.CertificateSet.CACertificates = mergeCACertIDs(tlsConfig.CertificateSet.CACertificates, req.caIDs)
+
+	if err := setWebServerTlsConfiguration(dev, tlsConfig); err != nil {
+		return fmt.Errorf("failed to set HTTPS configuration: %w", err)
+	}
+	return verifyHTTPSConfiguration(dev, req.policy, tlsConfig.CertificateSet.Certificates)
+}
+
+// mergeCACertIDs adds the lego CA certificates caIDs to the web server's CA
+// certificates. CA certificates added by the admin are kept, lego CA
+// certificates of earlier installs are replaced.
+func mergeCACertIDs(current, caIDs []string) []string {
+	var merged []string
+	for _, id := range current {
+		id = strings.TrimSpace(id)
+		if id != "" && !strings.HasPrefix(id, legoCACertIDPrefix) && !slices.Contains(merged, id) {
+			merged = append(merged, id)
+		}
+	}
+	for _, id := range caIDs {
+		if !slices.Contains(merged, id) {
+			merged = append(merged, id)
+		}
+	}
+	return merged
+}
+
+// snapshotWebServer saves the TLS configuration and the HTTPS redirect, which
+// the HTTPS policy may change during the install.
+func snapshotWebServer(dev *Device) (*targetSnapshot, error) {
+	previous, err := getWebServerTlsConfiguration(dev)
+	if err != nil {
+		return nil, err
+	}
+	redirect, err := getCameraParam(dev, httpsRedirectParam)
+	if err != nil && !errors.Is(err, errCameraParamMissing) {
+		return nil, err
+	}
+	hasRedirect := err == nil
+	snapshot := &targetSnapshot{target: TargetWebServer, restore: func() error {
+		if err := setWebServerTlsConfiguration(dev, previous); err != nil {
+			return err
+		}
+		if hasRedirect {
+			return setCameraParam(dev, httpsRedirectParam, redirect)
+		}
+		return nil
+	}}
+	if len(previous.CertificateSet.Certificates) > 0 {
+		snapshot.certID = strings.TrimSpace(previous.CertificateSet.Certificates[0])
+	}
+	return snapshot, nil
+}
+
+func webServerCerts(dev *Device) ([]string, error) {
+	tlsConfig, err := getWebServerTlsConfiguration(dev)
+	if err != nil {
+		return nil, err
+	}
+	return append(tlsConfig.CertificateSet.Certificates, tlsConfig.CertificateSet.CACertificates...), nil
+}
+
+const mqttClientPath = "/axis-cgi/mqtt/client.cgi"
+
+// mqttCall calls the MQTT client API. params may be nil.
+func mqttCall(dev *Device, method string, params any) (map[string]any, error) {
+	request := map[string]any{"apiVersion": "1.0", "context": "lego", "method": method}
+	if params != nil {
+		request["params"] = params
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dev.do("POST", mqttClientPath, "application/json", payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errTargetUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MQTT client request returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Data  map[string]any    `json:"data"`
+		Error *vapix.VapixError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse MQTT client response: %w", err)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("MQTT client error %d: %s", response.Error.Code, response.Error.Message)
+	}
+	return response.Data, nil
+}
+
+// mqttClientConfig returns the current MQTT client configuration. A client
+// that was never configured has an empty one.
+func mqttClientConfig(dev *Device) (map[string]any, error) {
+	data, err := mqttCall(dev, "getClientStatus", nil)
+	if err != nil {
+		return nil, err
+	}
+	config, _ := data["config"].(map[string]any)
+	if config == nil {
+		config = map[string]any{}
+	}
+	return config, nil
+}
+
+// setMQTTClientCert sets the MQTT client certificate. Only the ssl settings are
+// sent, as the configuration read back lacks secrets like the broker password
+// that a full write would clear. The result is read back to check that
+// nothing else changed.
+func setMQTTClientCert(dev *Device, certID string) error {
+	before, err := mqttClientConfig(dev)
+	if err != nil {
+		return err
+	}
+	ssl := map[string]any{}
+	if current, ok := before["ssl"].(map[string]any); ok {
+		maps.Copy(ssl, current)
+	}
+	ssl["clientCertID"] = certID
+	if _, err := mqttCall(dev, "configureClient", map[string]any{"ssl": ssl}); err != nil {
+		return err
+	}
+
+	after, err := mqttClientConfig(dev)
+	if err != nil {
+		return fmt.Errorf("failed to verify MQTT client configuration: %w", err)
+	}
+	afterSSL, _ := after["ssl"].(map[string]any)
+	if got, _ := afterSSL["clientCertID"].(string); got != certID {
+		return fmt.Errorf("MQTT client uses certificate %q, expected %q", got, certID)
+	}
+	for key, value := range before {
+		if key != "ssl" && !reflect.DeepEqual(after[key], value) {
+			return fmt.Errorf("MQTT client setting %s changed while setting the certificate", key)
+		}
+	}
+	return nil
+}
+
+// bindMQTT sets the certificate as MQTT client certificate.
+func bindMQTT(dev *Device, req *bindRequest) error {
+	return setMQTTClientCert(dev, req.certID)
+}
+
+// snapshotMQTT records the MQTT client certificate. Like bindMQTT, the restore
+// only touches the client certificate.
+func snapshotMQTT(dev *Device) (*targetSnapshot, error) {
+	previous, err := mqttClientConfig(dev)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &targetSnapshot{target: TargetMQTT}
+	if ssl, ok := previous["ssl"].(map[string]any); ok {
+		snapshot.certID, _ = ssl["clientCertID"].(string)
+	}
+	snapshot.restore = func() error {
+		return setMQTTClientCert(dev, snapshot.certID)
+	}
+	return snapshot, nil
+}
+
+func mqttCerts(dev *Device) ([]string, error) {
+	config, err := mqttClientConfig(dev)
+	if err != nil {
+		return nil, err
+	}
+	ssl, _ := config["ssl"].(map[string]any)
+	var ids []string
+	for _, key := range []string{"clientCertID", "CACertID"} {
+		if id, ok := ssl[key].(string); ok && id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// eapMethodTLS is the EAP-TLS method number, the only one using a client certificate.
+const eapMethodTLS = 13
+
+// dot1XConfiguration is an ONVIF 802.1X configuration.
+type dot1XConfiguration struct {
+	Token           string   `xml:"Dot1XConfigurationToken"`
+	Identity        string   `xml:"Identity"`
+	AnonymousID     string   `xml:"AnonymousID"`
+	EAPMethod       int      `xml:"EAPMethod"`
+	CACertificateID []string `xml:"CACertificateID"`
+	CertificateID   string   `xml:"EAPMethodConfiguration>TLSConfiguration>CertificateID"`
+}
+
+func getDot1XConfigurations(dev *Device) ([]dot1XConfiguration, error) {
+	var resp getDot1XConfigurationsResponse
+	if err := vapixSOAPPost(dev, &getDot1XConfigurationsRequest{}, &resp); err != nil {
+		var fault *SOAPFault
+		if errors.As(err, &fault) && (fault.HasSubcode("ActionNotSupported") || fault.HasSubcode("NotSupported")) {
+			return nil, errTargetUnsupported
+		}
+		return nil, err
+	}
+	return resp.Configurations, nil
+}
+
+// bindDot1X sets the certificate as client certificate of every EAP-TLS
+// 802.1X configuration.
+func bindDot1X(dev *Device, req *bindRequest) error {
+	configs, err := getDot1XConfigurations(dev)
+	if err != nil {
+		return err
+	}
+	bound := 0
+	for _, c := range configs {
+		if c.EAPMethod != eapMethodTLS {
+			continue
+		}
+		if err := setDot1XCertificate(dev, c, req.certID); err != nil {
+			return err
+		}
+		bound++
+	}
+	if bound == 0 {
+		return fmt.Errorf("no EAP-TLS 802.1X configuration on the camera")
+	}
+	return nil
+}
+
+// setDot1XCertificate writes back the 802.1X configuration c with certID as
+// client certificate.
+func setDot1XCertificate(dev *Device, c dot1XConfiguration, certID string) error {
+	set := &setDot1XConfigurationRequest{}
+	set.Dot1XConfiguration.Token = c.Token
+	set.Dot1XConfiguration.Identity = c.Identity
+	set.Dot1XConfiguration.AnonymousID = c.AnonymousID
+	set.Dot1XConfiguration.EAPMethod = c.EAPMethod
+	set.Dot1XConfiguration.CACertificateID = c.CACertificateID
+	set.Dot1XConfiguration.EAPMethodConfiguration.TLSConfiguration.CertificateID = certID
+	if err := vapixSOAPPost(dev, set, nil); err != nil {
+		return fmt.Errorf("failed to set 802.1X configuration %s: %w", c.Token, err)
+	}
+	return nil
+}
+
+func snapshotDot1X(dev *Device) (*targetSnapshot, error) {
+	previous, err := getDot1XConfigurations(dev)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &targetSnapshot{target: TargetDot1X, restore: func() error {
+		for _, c := range previous {
+			if c.EAPMethod != eapMethodTLS {
+				continue
+			}
+			if err := setDot1XCertificate(dev, c, c.CertificateID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	for _, c := range previous {
+		if c.EAPMethod == eapMethodTLS && c.CertificateID != "" {
+			snapshot.certID = c.CertificateID
+			break
+		}
+	}
+	return snapshot, nil
+}
+
+func dot1XCerts(dev *Device) ([]string, error) {
+	configs, err := getDot1XConfigurations(dev)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, c := range configs {
+		ids = append(ids, c.CACertificateID...)
+		if c.CertificateID != "" {
+			ids = append(ids, c.CertificateID)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateInstallTargetProfiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles string
+		wantErr  string
+	}{
+		{"none", "", ""},
+		{"primary domain", `{"cam.example.com": "webserver,mqtt"}`, ""},
+		{"primary domain in other case", `{"Cam.Example.com": "dot1x"}`, ""},
+		{"SAN", `{"door.example.com": "dot1x"}`, "only the primary domain"},
+		{"unknown domain", `{"other.example.com": "webserver"}`, "only the primary domain"},
+		{"unknown target", `{"cam.example.com": "ftp"}`, "install targets of cam.example.com"},
+		{"not an object", `["webserver"]`, "invalid install target profiles"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Domains: "cam.example.com,door.example.com", InstallTargetProfiles: tt.profiles}
+			err := validateInstallTargets(config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
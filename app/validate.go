@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Validation error codes returned to the API and WebSocket clients.
+const (
+	ValidationInvalidCert      = "invalid_certificate"
+	ValidationInvalidKey       = "invalid_key"
+	ValidationKeyMismatch      = "key_mismatch"
+	ValidationNotYetValid      = "not_yet_valid"
+	ValidationExpired          = "expired"
+	ValidationHostnameMismatch = "hostname_mismatch"
+)
+
+// CertValidationError reports why a certificate and key can't be installed.
+type CertValidationError struct {
+	Code    string
+	Message string
+}
+
+func (e *CertValidationError) Error() string {
+	return e.Message
+}
+
+// validateCertForInstall checks that key pairs with cert, that cert is currently
+// valid and that it covers hostname. pkcs8Key is the DER-encoded PKCS#8 private key.
+func validateCertForInstall(cert *x509.Certificate, pkcs8Key []byte, hostname string) error {
+	key, err := x509.ParsePKCS8PrivateKey(pkcs8Key)
+	if err != nil {
+		return &CertValidationError{ValidationInvalidKey, fmt.Sprintf("private key can't be parsed: %s", err)}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return &CertValidationError{ValidationInvalidKey, fmt.Sprintf("unsupported private key type %T", key)}
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return &CertValidationError{ValidationKeyMismatch, "private key does not match the certificate"}
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return &CertValidationError{ValidationNotYetValid,
+			fmt.Sprintf("certificate is not valid before %s", cert.NotBefore.Format(time.RFC3339))}
+	}
+	if now.After(cert.NotAfter) {
+		return &CertValidationError{ValidationExpired,
+			fmt.Sprintf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))}
+	}
+
+	if !certCoversHostname(cert, hostname) {
+		return &CertValidationError{ValidationHostnameMismatch,
+			fmt.Sprintf("certificate does not cover %s (SANs: %s)", hostname, strings.Join(cert.DNSNames, ", "))}
+	}
+	return nil
+}
+
+// certCoversHostname reports whether cert is valid for hostname. Wildcard
+// hostnames must be listed literally in the SANs.
+func certCoversHostname(cert *x509.Certificate, hostname string) bool {
+	if strings.HasPrefix(hostname, "*.") {
+		return slices.ContainsFunc(cert.DNSNames, func(name string) bool {
+			return strings.EqualFold(name, hostname)
+		})
+	}
+	return cert.VerifyHostname(hostname) == nil
+}
+
+// errorPayload returns the API/WebSocket error body for err, including the
+// validation code for a CertValidationError.
+func errorPayload(message string, err error) map[string]string {
+	payload := map[string]string{"error": message}
+	var verr *CertValidationError
+	if errors.As(err, &verr) {
+		payload["code"] = verr.Code
+	}
+	return payload
+}
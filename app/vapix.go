@@ -2,250 +2,442 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
-
-	"github.com/Cacsjep/goxis/pkg/vapix"
 )
 
 var httpSOAPClient = &http.Client{Timeout: 30 * time.Second}
 
 const (
-	vapixServicesPath = "/vapix/services"
-	legoCertIDPrefix  = "lego-"
+	vapixServicesPath  = "/vapix/services"
+	legoCertIDPrefix   = "lego-"
+	legoCACertIDPrefix = "lego-ca-"
 )
 
-func soapEnvelope(body string) string {
-	return `<?xml version="1.0" encoding="UTF-8"?>
-<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://www.w3.org/2003/05/soap-envelope"
-    xmlns:tds="http://www.onvif.org/ver10/device/wsdl"
-    xmlns:tt="http://www.onvif.org/ver10/schema">
-  <SOAP-ENV:Body>` + body + `</SOAP-ENV:Body>
-</SOAP-ENV:Envelope>`
-}
-
-func vapixSOAPPost(username, password, body string) ([]byte, error) {
-	envelope := soapEnvelope(body)
-	url := vapix.InternalVapixUrlPathJoin(vapixServicesPath)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBufferString(envelope))
+// vapixSOAPPost sends a SOAP request to dev and decodes the response body into
+// response, which may be nil. SOAP faults are returned as *SOAPFault.
+func vapixSOAPPost(dev *Device, request, response any) error {
+	envelope, err := marshalSOAPRequest(request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
-	req.Header.Set("Content-Type", "application/soap+xml")
-	req.SetBasicAuth(username, password)
 
-	resp, err := httpSOAPClient.Do(req)
+	resp, err := dev.do("POST", vapixServicesPath, "application/soap+xml", envelope)
 	if err != nil {
-		return nil, fmt.Errorf("SOAP request failed: %w", err)
+		return fmt.Errorf("SOAP request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return fmt.Errorf("failed to read response: %w", err)
 	}
 
-	respStr := string(respBody)
+	// A fault is reported with both 200 and non-200 status codes
+	err = unmarshalSOAPResponse(respBody, response)
+	var fault *SOAPFault
+	if errors.As(err, &fault) {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("SOAP request returned status %d", resp.StatusCode)
+	}
+	return err
+}
 
-	// Check for SOAP Fault (works for both 200 and non-200 responses)
-	if strings.Contains(respStr, "Fault") {
-		reason := extractSOAPText(respStr, "Reason")
-		detail := extractSOAPText(respStr, "Detail")
-		msg := "SOAP fault"
-		if reason != "" {
-			msg = reason
-		}
-		if detail != "" {
-			msg += ": " + detail
-		}
-		return respBody, errors.New(msg)
+// soapBackend manages certificates via ONVIF and the Axis web server SOAP service.
+var soapBackend = certBackend{
+	name:               BackendSOAP,
+	listCertificates:   soapListCertificates,
+	listCACertificates: soapListCACertificates,
+	loadCertificate:    soapLoadCertificate,
+	loadCACertificate:  soapLoadCACertificate,
+	deleteCertificate:  soapDeleteCertificate,
+	getWebServerTLS:    soapGetWebServerTLS,
+	setWebServerTLS:    soapSetWebServerTLS,
+}
+
+func soapListCertificates(dev *Device) ([]certificateEntry, error) {
+	var resp getCertificatesResponse
+	if err := vapixSOAPPost(dev, &getCertificatesRequest{}, &resp); err != nil {
+		return nil, err
 	}
+	return resp.Certificates, nil
+}
 
-	if resp.StatusCode != 200 {
-		return respBody, fmt.Errorf("SOAP request returned status %d", resp.StatusCode)
+func soapListCACertificates(dev *Device) ([]certificateEntry, error) {
+	var resp getCACertificatesResponse
+	if err := vapixSOAPPost(dev, &getCACertificatesRequest{}, &resp); err != nil {
+		return nil, err
 	}
+	return resp.Certificates, nil
+}
 
-	return respBody, nil
+func soapLoadCertificate(dev *Device, id string, cert, key []byte) error {
+	var upload loadCertificateWithPrivateKeyRequest
+	upload.CertificateWithPrivateKey.CertificateID = id
+	upload.CertificateWithPrivateKey.Certificate.Data = base64.StdEncoding.EncodeToString(cert)
+	upload.CertificateWithPrivateKey.PrivateKey.Data = base64.StdEncoding.EncodeToString(key)
+	return vapixSOAPPost(dev, &upload, nil)
 }
 
-// InstallCertToCamera uploads the lego certificate and private key to the camera
-// and configures it as the HTTPS certificate. Uses a timestamped cert ID so each
-// install gets a unique ID, then cleans up old lego- certs after switching HTTPS.
-func InstallCertToCamera(username, password, domain string) error {
-	certFile := legoCertsPath + "/certificates/" + domain + ".crt"
-	keyFile := legoCertsPath + "/certificates/" + domain + ".key"
+func soapLoadCACertificate(dev *Device, id string, cert []byte) error {
+	upload := &loadCACertificatesRequest{CACertificate: []onvifCertificate{{CertificateID: id}}}
+	upload.CACertificate[0].Certificate.Data = base64.StdEncoding.EncodeToString(cert)
+	return vapixSOAPPost(dev, upload, nil)
+}
 
-	// Read and encode certificate
-	certPEM, err := os.ReadFile(certFile)
-	if err != nil {
-		return fmt.Errorf("failed to read certificate: %w", err)
+func soapDeleteCertificate(dev *Device, id string) error {
+	return vapixSOAPPost(dev, &deleteCertificatesRequest{CertificateID: []string{id}}, nil)
+}
+
+func soapGetWebServerTLS(dev *Device) (*webServerTlsConfiguration, error) {
+	var resp getWebServerTlsConfigurationResponse
+	if err := vapixSOAPPost(dev, &getWebServerTlsConfigurationRequest{}, &resp); err != nil {
+		return nil, err
 	}
+	return &resp.Configuration, nil
+}
 
-	certBlock, _ := pem.Decode(certPEM)
-	if certBlock == nil {
-		return fmt.Errorf("failed to decode certificate PEM")
+// soapSetWebServerTLS writes c with SetWebServerTlsConfiguration. Connection
+// policies the camera didn't report are left out.
+func soapSetWebServerTLS(dev *Device, c *webServerTlsConfiguration) error {
+	req := &setWebServerTlsConfigurationRequest{}
+	req.Configuration.Tls = c.Tls
+	req.Configuration.ConnectionPolicies.Admin = c.ConnectionPolicies.Admin
+	req.Configuration.ConnectionPolicies.Operator = c.ConnectionPolicies.Operator
+	req.Configuration.ConnectionPolicies.Viewer = c.ConnectionPolicies.Viewer
+	req.Configuration.Ciphers.Cipher = c.Ciphers
+	req.Configuration.CertificateSet.Certificates.ID = c.CertificateSet.Certificates
+	req.Configuration.CertificateSet.CACertificates.ID = c.CertificateSet.CACertificates
+	req.Configuration.CertificateSet.TrustedCertificates.ID = c.CertificateSet.TrustedCertificates
+	return vapixSOAPPost(dev, req, nil)
+}
+
+// InstallCertToCamera uploads the lego certificate of domain and its private key
+// to dev and binds it to the target services, the web server together with
+// policy. The certificate must cover hostname. Uses a timestamped cert ID so
+// each install gets a unique ID, then cleans up old lego- certs no service uses
+// anymore.
+//
+// The install is transactional: the current bindings are recorded first, and
+// if binding fails or HTTPS doesn't present the new certificate afterwards,
+// they are restored and the uploaded certificate is deleted. Each step is
+// passed to report, which may be nil.
+func InstallCertToCamera(dev *Device, domain, hostname string, policy *HTTPSPolicy, targets []string, report func(InstallStep)) error {
+	step := installReporter(domain, report)
+	fail := func(name string, err error) error {
+		step(name, StepFailed, err.Error())
+		return err
 	}
-	certB64 := base64.StdEncoding.EncodeToString(certBlock.Bytes)
 
-	// Read and encode private key (convert to PKCS#8)
-	keyPEM, err := os.ReadFile(keyFile)
+	step(InstallStepValidate, StepRunning, "")
+	cert, key, err := readCertForInstall(domain, hostname)
 	if err != nil {
-		return fmt.Errorf("failed to read private key: %w", err)
+		return fail(InstallStepValidate, err)
 	}
-
-	keyBlock, _ := pem.Decode(keyPEM)
-	if keyBlock == nil {
-		return fmt.Errorf("failed to decode private key PEM")
+	chain, err := loadChain(domain)
+	if err != nil {
+		return fail(InstallStepValidate, fmt.Errorf("failed to read certificate chain: %w", err))
 	}
+	step(InstallStepValidate, StepDone, fmt.Sprintf("Certificate %s valid until %s", cert.SerialNumber, cert.NotAfter.Format(time.RFC3339)))
 
-	pkcs8Key, err := toPKCS8(keyBlock)
+	// Step 1: Record what each target uses now, so a failed install can be undone
+	step(InstallStepRecord, StepRunning, "")
+	snapshots, err := snapshotTargets(dev, targets)
 	if err != nil {
-		return fmt.Errorf("failed to convert key to PKCS#8: %w", err)
+		return fail(InstallStepRecord, err)
 	}
-	keyB64 := base64.StdEncoding.EncodeToString(pkcs8Key)
+	step(InstallStepRecord, StepDone, describeSnapshots(snapshots))
 
-	// Generate unique cert ID with timestamp (e.g. "lego-260215143025")
+	// Step 2: Upload the intermediates, so the camera serves the full chain, and
+	// the certificate with a unique ID (e.g. "lego-260215143025")
+	step(InstallStepUpload, StepRunning, "")
+	caIDs, err := installCACertificates(dev, chain[1:])
+	if err != nil {
+		return fail(InstallStepUpload, fmt.Errorf("failed to upload CA certificates: %w", err))
+	}
 	certID := legoCertIDPrefix + time.Now().Format("060102150405")
+	if err := dev.certs().loadCertificate(dev, certID, cert.Raw, key); err != nil {
+		return fail(InstallStepUpload, fmt.Errorf("failed to upload certificate: %w", err))
+	}
+	step(InstallStepUpload, StepDone, fmt.Sprintf("Uploaded as %s via %s", certID, dev.certs().name))
+
+	// Step 3: Bind the new certificate to each target service
+	req := &bindRequest{certID: certID, caIDs: caIDs, policy: policy}
+	var installErr error
+	touched := 0
+	for _, name := range targets {
+		// A failed bind may have been applied partially, so it is restored too
+		touched++
+		step(InstallStepBind, StepRunning, name)
+		if err := installTargets[name].bind(dev, req); err != nil {
+			installErr = fail(InstallStepBind, fmt.Errorf("failed to install certificate to %s: %w", name, err))
+			break
+		}
+		step(InstallStepBind, StepDone, name)
+	}
 
-	// Step 1: Upload new certificate with unique ID
-	uploadBody := fmt.Sprintf(`
-    <tds:LoadCertificateWithPrivateKey xmlns="http://www.onvif.org/ver10/device/wsdl">
-      <CertificateWithPrivateKey>
-        <tt:CertificateID>%s</tt:CertificateID>
-        <tt:Certificate><tt:Data>%s</tt:Data></tt:Certificate>
-        <tt:PrivateKey><tt:Data>%s</tt:Data></tt:PrivateKey>
-      </CertificateWithPrivateKey>
-    </tds:LoadCertificateWithPrivateKey>`, certID, certB64, keyB64)
+	// Step 4: Check with a TLS handshake that HTTPS presents the new certificate
+	switch {
+	case installErr != nil:
+	case !slices.Contains(targets, TargetWebServer):
+		step(InstallStepVerify, StepSkipped, "web server is not an install target")
+	default:
+		step(InstallStepVerify, StepRunning, "TLS handshake with "+dev.TLSAddr)
+		if err := verifyServedCertificate(dev, hostname, cert); err != nil {
+			installErr = fail(InstallStepVerify, fmt.Errorf("HTTPS verification failed: %w", err))
+		} else {
+			step(InstallStepVerify, StepDone, fmt.Sprintf("%s presents certificate %s", dev.TLSAddr, cert.SerialNumber))
+		}
+	}
+
+	if installErr != nil {
+		return rollbackInstall(dev, snapshots[:touched], certID, step, installErr)
+	}
 
-	if _, err := vapixSOAPPost(username, password, uploadBody); err != nil {
-		return fmt.Errorf("failed to upload certificate: %w", err)
+	// Step 5: Clean up old lego- certs and intermediates no service uses anymore
+	// (best-effort, skipped when a binding can't be read)
+	bound, err := boundCertificateIDs(dev)
+	if err != nil {
+		step(InstallStepCleanup, StepSkipped, err.Error())
+		return nil
 	}
+	keep := append(bound, certID)
+	cleanupOldLegoCerts(dev, keep)
+	cleanupOldLegoCACerts(dev, append(keep, caIDs...))
+	step(InstallStepCleanup, StepDone, "")
+	return nil
+}
 
-	// Step 2: Fetch available ciphers
-	ciphers, err := fetchCiphers(username, password)
+// readCertForInstall reads the lego certificate of domain and its private key
+// as PKCS#8, and validates them for hostname.
+func readCertForInstall(domain, hostname string) (*x509.Certificate, []byte, error) {
+	certPEM, err := os.ReadFile(legoCertPath(domain, ".crt"))
 	if err != nil {
-		return fmt.Errorf("failed to fetch ciphers: %w", err)
+		return nil, nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("failed to decode certificate PEM")
 	}
 
-	// Step 3: Set HTTPS to use the new certificate
-	var cipherXML string
-	for _, c := range ciphers {
-		c = strings.TrimSpace(c)
-		if c != "" {
-			cipherXML += fmt.Sprintf("<acert:Cipher>%s</acert:Cipher>", xmlEscape(c))
-		}
+	keyPEM, err := os.ReadFile(legoCertPath(domain, ".key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("failed to decode private key PEM")
+	}
+	pkcs8Key, err := toPKCS8(keyBlock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert key to PKCS#8: %w", err)
 	}
 
-	httpsBody := fmt.Sprintf(`
-    <SetWebServerTlsConfiguration xmlns="http://www.axis.com/vapix/ws/webserver"
-        xmlns:acert="http://www.axis.com/vapix/ws/cert">
-      <Configuration>
-        <Tls>true</Tls>
-        <ConnectionPolicies><Admin>HttpAndHttps</Admin></ConnectionPolicies>
-        <Ciphers>%s</Ciphers>
-        <CertificateSet>
-          <acert:Certificates><acert:Id>%s</acert:Id></acert:Certificates>
-          <acert:CACertificates></acert:CACertificates>
-          <acert:TrustedCertificates></acert:TrustedCertificates>
-        </CertificateSet>
-      </Configuration>
-    </SetWebServerTlsConfiguration>`, cipherXML, certID)
+	// Refuse mismatched, expired or foreign certificates before touching the camera
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, &CertValidationError{ValidationInvalidCert, fmt.Sprintf("certificate can't be parsed: %s", err)}
+	}
+	if err := validateCertForInstall(cert, pkcs8Key, hostname); err != nil {
+		return nil, nil, err
+	}
+	return cert, pkcs8Key, nil
+}
 
-	if _, err := vapixSOAPPost(username, password, httpsBody); err != nil {
-		return fmt.Errorf("failed to set HTTPS configuration: %w", err)
+// cleanupOldLegoCerts lists all certificates on the camera and deletes any
+// with IDs starting with "lego-" that aren't in keep.
+func cleanupOldLegoCerts(dev *Device, keep []string) {
+	ids, err := listCertificateIDs(dev)
+	if err != nil {
+		return
 	}
+	for _, id := range ids {
+		if strings.HasPrefix(id, legoCertIDPrefix) && !strings.HasPrefix(id, legoCACertIDPrefix) && !slices.Contains(keep, id) {
+			deleteCert(dev, id)
+		}
+	}
+}
 
-	// Step 4: Clean up old lego- certs (best-effort, the new cert is already active)
-	cleanupOldLegoCerts(username, password, certID)
+// caCertificateID returns the managed camera ID of an intermediate. It is derived
+// from the fingerprint, so an intermediate shared by renewals is uploaded once.
+func caCertificateID(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return legoCACertIDPrefix + hex.EncodeToString(sum[:8])
+}
 
-	return nil
+// installCACertificates uploads the intermediates of chain that aren't on the
+// camera yet and returns the IDs of all of them. Self-signed roots are skipped,
+// clients must not be sent those.
+func installCACertificates(dev *Device, chain []*x509.Certificate) ([]string, error) {
+	existing, err := listCACertificateIDs(dev)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, cert := range chain {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			continue
+		}
+		id := caCertificateID(cert)
+		ids = append(ids, id)
+		if slices.Contains(existing, id) {
+			continue
+		}
+		if err := dev.certs().loadCACertificate(dev, id, cert.Raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", cert.Subject.CommonName, err)
+		}
+	}
+	return ids, nil
 }
 
-// cleanupOldLegoCerts lists all certificates on the camera and deletes any
-// with IDs starting with "lego-" that aren't the current active cert.
-func cleanupOldLegoCerts(username, password, currentCertID string) {
-	ids, err := listCertificateIDs(username, password)
+// cleanupOldLegoCACerts deletes lego-ca- intermediates that aren't in keep.
+func cleanupOldLegoCACerts(dev *Device, keep []string) {
+	ids, err := listCACertificateIDs(dev)
 	if err != nil {
 		return
 	}
 	for _, id := range ids {
-		if strings.HasPrefix(id, legoCertIDPrefix) && id != currentCertID {
-			deleteCert(username, password, id)
+		if strings.HasPrefix(id, legoCACertIDPrefix) && !slices.Contains(keep, id) {
+			deleteCert(dev, id)
 		}
 	}
 }
 
-// listCertificateIDs retrieves all certificate IDs from the camera via ONVIF GetCertificates.
-func listCertificateIDs(username, password string) ([]string, error) {
-	body := `<tds:GetCertificates xmlns="http://www.onvif.org/ver10/device/wsdl"/>`
-	resp, err := vapixSOAPPost(username, password, body)
+// listCACertificateIDs retrieves all CA certificate IDs from the camera.
+func listCACertificateIDs(dev *Device) ([]string, error) {
+	entries, err := dev.certs().listCACertificates(dev)
 	if err != nil {
 		return nil, err
 	}
-	return extractCertIDs(string(resp)), nil
+	return certificateIDs(entries), nil
 }
 
-// extractCertIDs parses certificate IDs from a GetCertificates SOAP response.
-func extractCertIDs(xml string) []string {
+// listCertificateIDs retrieves all certificate IDs from the camera.
+func listCertificateIDs(dev *Device) ([]string, error) {
+	entries, err := dev.certs().listCertificates(dev)
+	if err != nil {
+		return nil, err
+	}
+	return certificateIDs(entries), nil
+}
+
+func certificateIDs(entries []certificateEntry) []string {
 	var ids []string
-	search := xml
-	for {
-		start := strings.Index(search, "<tt:CertificateID>")
-		if start < 0 {
-			break
-		}
-		start += len("<tt:CertificateID>")
-		end := strings.Index(search[start:], "</tt:CertificateID>")
-		if end < 0 {
-			break
-		}
-		id := strings.TrimSpace(search[start : start+end])
-		if id != "" {
+	for _, e := range entries {
+		if id := strings.TrimSpace(e.ID); id != "" {
 			ids = append(ids, id)
 		}
-		search = search[start+end:]
 	}
 	return ids
 }
 
-func deleteCert(username, password, certID string) {
-	body := fmt.Sprintf(`
-    <tds:DeleteCertificates xmlns="http://www.onvif.org/ver10/device/wsdl">
-      <CertificateID>%s</CertificateID>
-    </tds:DeleteCertificates>`, certID)
-	vapixSOAPPost(username, password, body)
+// webServerTlsConfiguration is the web server TLS configuration of the camera.
+// Elements are matched by local name when parsing, so namespace prefixes don't matter.
+type webServerTlsConfiguration struct {
+	Tls                bool               `xml:"Tls" json:"tls"`
+	ConnectionPolicies connectionPolicies `xml:"ConnectionPolicies" json:"connection_policies"`
+	Ciphers            []string           `xml:"Ciphers>Cipher" json:"ciphers"`
+	CertificateSet     certificateSet     `xml:"CertificateSet" json:"certificate_set"`
+}
+
+// connectionPolicies holds HttpOnly, HttpsOnly or HttpAndHttps per user group.
+type connectionPolicies struct {
+	Admin    string `xml:"Admin" json:"admin,omitempty"`
+	Operator string `xml:"Operator" json:"operator,omitempty"`
+	Viewer   string `xml:"Viewer" json:"viewer,omitempty"`
+}
+
+type certificateSet struct {
+	Certificates        []string `xml:"Certificates>Id" json:"certificates"`
+	CACertificates      []string `xml:"CACertificates>Id" json:"ca_certificates"`
+	TrustedCertificates []string `xml:"TrustedCertificates>Id" json:"trusted_certificates"`
+}
+
+// getWebServerTlsConfiguration reads the current web server TLS configuration.
+func getWebServerTlsConfiguration(dev *Device) (*webServerTlsConfiguration, error) {
+	return dev.certs().getWebServerTLS(dev)
+}
+
+// setWebServerTlsConfiguration writes back c as is.
+func setWebServerTlsConfiguration(dev *Device, c *webServerTlsConfiguration) error {
+	return dev.certs().setWebServerTLS(dev, c.trimmed())
+}
+
+// trimmed returns a copy of c without whitespace around IDs and ciphers.
+func (c *webServerTlsConfiguration) trimmed() *webServerTlsConfiguration {
+	trim := func(values []string) []string {
+		var out []string
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+	out := *c
+	out.Ciphers = trim(c.Ciphers)
+	out.CertificateSet.Certificates = trim(c.CertificateSet.Certificates)
+	out.CertificateSet.CACertificates = trim(c.CertificateSet.CACertificates)
+	out.CertificateSet.TrustedCertificates = trim(c.CertificateSet.TrustedCertificates)
+	return &out
 }
 
-func fetchCiphers(username, password string) ([]string, error) {
-	url := vapix.InternalVapixUrlPathJoin("/axis-cgi/param.cgi?action=list&group=HTTPS.Ciphers")
-	result := vapix.VapixGet(username, password, url)
-	if !result.IsOk {
-		return nil, fmt.Errorf("failed to fetch ciphers: %v", result.Error)
+// getActiveCertificateID returns the ID of the certificate the camera's web server uses.
+func getActiveCertificateID(dev *Device) (string, error) {
+	config, err := getWebServerTlsConfiguration(dev)
+	if err != nil {
+		return "", err
+	}
+	if len(config.CertificateSet.Certificates) == 0 {
+		return "", fmt.Errorf("web server has no certificate configured")
 	}
-	defer result.ResponseReader.Close()
+	return strings.TrimSpace(config.CertificateSet.Certificates[0]), nil
+}
 
-	body, err := io.ReadAll(result.ResponseReader)
+// getCameraCertificate fetches and parses the certificate with the given ID from the camera.
+func getCameraCertificate(dev *Device, certID string) (*x509.Certificate, error) {
+	entries, err := dev.certs().listCertificates(dev)
 	if err != nil {
 		return nil, err
 	}
+	for _, c := range entries {
+		if strings.TrimSpace(c.ID) != certID {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(c.Data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode certificate %s: %w", certID, err)
+		}
+		return x509.ParseCertificate(der)
+	}
+	return nil, fmt.Errorf("certificate %s not found on camera", certID)
+}
 
-	// Response format: root.HTTPS.Ciphers=CIPHER1:CIPHER2:...
-	line := strings.TrimSpace(string(body))
-	idx := strings.Index(line, "=")
-	if idx < 0 {
-		return nil, fmt.Errorf("unexpected cipher response: %s", line)
+func deleteCert(dev *Device, certID string) error {
+	return dev.certs().deleteCertificate(dev, certID)
+}
+
+// fetchSupportedCiphers returns the ciphers the camera supports.
+func fetchSupportedCiphers(dev *Device) ([]string, error) {
+	// Value format: CIPHER1:CIPHER2:...
+	value, err := getCameraParam(dev, httpsAvailableCiphersParam)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch supported ciphers: %w", err)
 	}
-	cipherStr := line[idx+1:]
-	return strings.Split(cipherStr, ":"), nil
+	return splitCiphers(value), nil
 }
 
 func toPKCS8(block *pem.Block) ([]byte, error) {
@@ -268,36 +460,3 @@ func toPKCS8(block *pem.Block) ([]byte, error) {
 	}
 	return x509.MarshalPKCS8PrivateKey(key)
 }
-
-func xmlEscape(s string) string {
-	r := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;", "'", "&apos;")
-	return r.Replace(s)
-}
-
-// extractSOAPText extracts the text content from a SOAP element like
-// <SOAP-ENV:Reason><SOAP-ENV:Text xml:lang="en">Invalid ID</SOAP-ENV:Text></SOAP-ENV:Reason>
-func extractSOAPText(xml, element string) string {
-	// Look for <SOAP-ENV:{element}> ... <SOAP-ENV:Text ...>VALUE</SOAP-ENV:Text>
-	start := strings.Index(xml, "<SOAP-ENV:"+element+">")
-	if start < 0 {
-		return ""
-	}
-	sub := xml[start:]
-	// Find <SOAP-ENV:Text (with possible attributes like xml:lang="en")
-	textStart := strings.Index(sub, "<SOAP-ENV:Text")
-	if textStart < 0 {
-		return ""
-	}
-	// Skip past the closing >
-	gt := strings.Index(sub[textStart:], ">")
-	if gt < 0 {
-		return ""
-	}
-	contentStart := textStart + gt + 1
-	// Find closing </SOAP-ENV:Text>
-	contentEnd := strings.Index(sub[contentStart:], "</SOAP-ENV:Text>")
-	if contentEnd < 0 {
-		return ""
-	}
-	return strings.TrimSpace(sub[contentStart : contentStart+contentEnd])
-}
@@ -15,6 +15,14 @@ const (
 	MsgLegoOutput       = "lego_output"
 	MsgLegoComplete     = "lego_complete"
 	MsgLegoError        = "lego_error"
+	MsgEnsureResult     = "ensure_result"
+	MsgCertDrift        = "cert_drift"
+	MsgSchedule         = "schedule"
+	MsgCTUnknown        = "ct_unknown_issuance"
+	MsgCertExpiring     = "cert_expiring"
+	MsgDevicePush       = "device_push"
+	MsgInstallStep      = "install_step"
+	MsgHookResult       = "hook_result"
 )
 
 // WSMessage is the envelope sent to WebSocket clients.